@@ -0,0 +1,388 @@
+// Package binrpc implements a compact length-prefixed binary ClientCodec
+// and ServerCodec for the rpc package, for peers written in languages
+// other than Go.
+//
+// Every request and response is a single frame made of a fixed 16-byte
+// header followed by an opaque body:
+//
+//	length uint32 // number of bytes following this field, 12 + len(body)
+//	cmd    uint32
+//	seq    uint32
+//	error  uint32 // error code of a response, always 0 in requests
+//	body   [length-12]byte
+//
+// Header fields use the byte order configured in Options, big-endian by
+// default.  Bodies are encoded by a pluggable Marshaler.  The frame has
+// no room for the rpc control frames, so cancellations are not sent.
+//
+// A client setting Options.Compression wraps the connection with
+// rpc.CompressConn.  A server setting it accepts both such clients and
+// those that don't compress, with rpc.AcceptCompression; one leaving it
+// nil serves plain frames only.
+package binrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+
+	rpc "github.com/lijie/go/rpc"
+)
+
+// HeaderSize is the size of the fixed frame header, length field included.
+const HeaderSize = 16
+
+// DefaultMaxFrameSize is the largest frame accepted unless Options says
+// otherwise.
+const DefaultMaxFrameSize = 16 << 20
+
+// A Marshaler encodes and decodes frame bodies.
+type Marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// A TypeChecker is a Marshaler that can tell in advance whether it
+// encodes and decodes the values of a type.  NewServer uses it to reject
+// the handlers the Marshaler could not serve.
+type TypeChecker interface {
+	CheckType(t reflect.Type) error
+}
+
+// Fixed is the default Marshaler.  A []byte body is sent as is and a
+// *[]byte receives the raw body; values implementing
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler encode
+// themselves; anything else must be fixed-size data as understood by
+// encoding/binary, which matches packed C structs, and is encoded in
+// Order.
+type Fixed struct {
+	Order binary.ByteOrder
+}
+
+func (m Fixed) Marshal(v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case []byte:
+		return x, nil
+	case *[]byte:
+		return *x, nil
+	case encoding.BinaryMarshaler:
+		return x.MarshalBinary()
+	}
+	size := binary.Size(v)
+	if size < 0 {
+		return nil, fmt.Errorf("binrpc: cannot marshal %T", v)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if err := binary.Write(buf, m.Order, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	typeOfBytes             = reflect.TypeOf([]byte(nil))
+	typeOfBinaryMarshaler   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	typeOfBinaryUnmarshaler = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// CheckType reports whether values of type t, or pointers to them, can be
+// both marshaled and unmarshaled by Fixed.
+func (m Fixed) CheckType(t reflect.Type) error {
+	if t.Kind() != reflect.Ptr {
+		t = reflect.PtrTo(t)
+	}
+	if t.Elem() == typeOfBytes {
+		return nil
+	}
+	if t.Implements(typeOfBinaryMarshaler) && t.Implements(typeOfBinaryUnmarshaler) {
+		return nil
+	}
+	if binary.Size(reflect.New(t.Elem()).Interface()) < 0 {
+		return fmt.Errorf("binrpc: cannot marshal %v", t.Elem())
+	}
+	return nil
+}
+
+func (m Fixed) Unmarshal(data []byte, v interface{}) error {
+	switch x := v.(type) {
+	case *[]byte:
+		*x = append((*x)[:0], data...)
+		return nil
+	case encoding.BinaryUnmarshaler:
+		return x.UnmarshalBinary(data)
+	}
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, m.Order, v); err != nil {
+		return fmt.Errorf("binrpc: cannot unmarshal %T: %v", v, err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("binrpc: %d trailing bytes unmarshaling %T", r.Len(), v)
+	}
+	return nil
+}
+
+// Options configures a codec.  The zero value is usable.
+type Options struct {
+	ByteOrder    binary.ByteOrder // header byte order, default big-endian
+	Marshaler    Marshaler        // body encoding, default Fixed in ByteOrder
+	MaxFrameSize uint32           // largest accepted frame, default DefaultMaxFrameSize
+	// Compression compresses the data sent.  If it is nil, a client sends
+	// uncompressed frames, as servers that predate compression expect,
+	// and a server does not accept compressing clients.
+	Compression *rpc.Compression
+}
+
+func (o *Options) withDefaults() Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.ByteOrder == nil {
+		opts.ByteOrder = binary.BigEndian
+	}
+	if opts.Marshaler == nil {
+		opts.Marshaler = Fixed{opts.ByteOrder}
+	}
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = DefaultMaxFrameSize
+	}
+	return opts
+}
+
+var errFrameTooLarge = errors.New("binrpc: frame too large")
+
+// header is the decoded fixed part of a frame.
+type header struct {
+	cmd, seq, errcode uint32
+}
+
+// framer reads and writes frames on a connection.
+type framer struct {
+	opts Options
+	rwc  io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+	hdr  [HeaderSize]byte
+	body []byte // body of the last frame read
+}
+
+func newFramer(conn io.ReadWriteCloser, o *Options) framer {
+	return framer{
+		opts: o.withDefaults(),
+		rwc:  conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+func (f *framer) readFrame() (h header, err error) {
+	if _, err = io.ReadFull(f.r, f.hdr[:]); err != nil {
+		return
+	}
+	order := f.opts.ByteOrder
+	length := order.Uint32(f.hdr[0:])
+	if length < HeaderSize-4 {
+		return h, fmt.Errorf("binrpc: invalid frame length %d", length)
+	}
+	if uint64(length)+4 > uint64(f.opts.MaxFrameSize) {
+		return h, errFrameTooLarge
+	}
+	h.cmd = order.Uint32(f.hdr[4:])
+	h.seq = order.Uint32(f.hdr[8:])
+	h.errcode = order.Uint32(f.hdr[12:])
+	n := int(length) - (HeaderSize - 4)
+	if cap(f.body) < n {
+		f.body = make([]byte, n)
+	}
+	f.body = f.body[:n]
+	if _, err = io.ReadFull(f.r, f.body); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (f *framer) readBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	return f.opts.Marshaler.Unmarshal(f.body, x)
+}
+
+// marshal encodes the body of a frame.
+func (f *framer) marshal(x interface{}) ([]byte, error) {
+	body, err := f.opts.Marshaler.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(body))+HeaderSize > uint64(f.opts.MaxFrameSize) {
+		return nil, errFrameTooLarge
+	}
+	return body, nil
+}
+
+// write writes a frame made of h and an encoded body.
+func (f *framer) write(h header, body []byte) error {
+	order := f.opts.ByteOrder
+	order.PutUint32(f.hdr[0:], uint32(len(body)+HeaderSize-4))
+	order.PutUint32(f.hdr[4:], h.cmd)
+	order.PutUint32(f.hdr[8:], h.seq)
+	order.PutUint32(f.hdr[12:], h.errcode)
+	if _, err := f.w.Write(f.hdr[:]); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(body); err != nil {
+		return err
+	}
+	return f.w.Flush()
+}
+
+func (f *framer) writeFrame(h header, x interface{}) error {
+	body, err := f.marshal(x)
+	if err != nil {
+		return err
+	}
+	return f.write(h, body)
+}
+
+type serverCodec struct {
+	framer
+}
+
+// NewServer returns a new rpc.Server whose Register rejects the handlers
+// taking or replying types that the Marshaler of opts cannot encode, if it
+// is a TypeChecker.  opts may be nil.
+func NewServer(opts *Options) *rpc.Server {
+	server := rpc.NewServer()
+	if check, ok := opts.withDefaults().Marshaler.(TypeChecker); ok {
+		server.SetTypeCheck(check.CheckType)
+	}
+	return server
+}
+
+// NewServerCodec returns a new rpc.ServerCodec using binary frames on conn.
+// opts may be nil.
+func NewServerCodec(conn io.ReadWriteCloser, opts *Options) rpc.ServerCodec {
+	if opts != nil && opts.Compression != nil {
+		conn = rpc.AcceptCompression(conn, *opts.Compression)
+	}
+	return &serverCodec{newFramer(conn, opts)}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	h, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	r.Cmd = h.cmd
+	r.Seq = h.seq
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(x interface{}) error {
+	return c.readBody(x)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	if r.Kind != rpc.KindCall {
+		// The frame cannot carry pings and other control frames.
+		return nil
+	}
+	if r.Error != 0 {
+		return c.write(header{r.Cmd, r.Seq, r.Error}, nil)
+	}
+	body, err := c.marshal(x)
+	if err != nil {
+		// Fail the call rather than leave the client waiting for a reply.
+		if werr := c.write(header{r.Cmd, r.Seq, uint32(rpc.ErrInternal)}, nil); werr != nil {
+			return werr
+		}
+		return err
+	}
+	return c.write(header{r.Cmd, r.Seq, r.Error}, body)
+}
+
+// RemoteAddr returns the peer address if the codec serves a net.Conn.
+func (c *serverCodec) RemoteAddr() net.Addr {
+	if conn, ok := c.rwc.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *serverCodec) Close() error {
+	return c.rwc.Close()
+}
+
+type clientCodec struct {
+	framer
+}
+
+// NewClientCodec returns a new rpc.ClientCodec using binary frames on conn.
+// opts may be nil.
+func NewClientCodec(conn io.ReadWriteCloser, opts *Options) rpc.ClientCodec {
+	if opts != nil && opts.Compression != nil {
+		conn = rpc.CompressConn(conn, *opts.Compression)
+	}
+	return &clientCodec{newFramer(conn, opts)}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, x interface{}) error {
+	if r.Kind == rpc.KindStream || r.Kind == rpc.KindDuplex {
+		return rpc.ErrNoStreams
+	}
+	if r.Kind == rpc.KindHello {
+		return rpc.ErrNoMetadata
+	}
+	if r.Kind != rpc.KindCall {
+		// The frame cannot carry control frames.
+		return nil
+	}
+	return c.writeFrame(header{r.Cmd, r.Seq, 0}, x)
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	h, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	r.Cmd = h.cmd
+	r.Seq = h.seq
+	r.Error = h.errcode
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(x interface{}) error {
+	return c.readBody(x)
+}
+
+func (c *clientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// NewClient returns a new rpc.Client to handle requests to the
+// set of services at the other end of the connection.
+func NewClient(conn io.ReadWriteCloser, opts *Options) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodec(conn, opts))
+}
+
+// Dial connects to a binrpc server at the specified network address.
+func Dial(network, address string, opts *Options) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, opts), nil
+}
+
+// ServeConn runs the binrpc server on a single connection.
+// ServeConn blocks, serving the connection until the client hangs up.
+// The caller typically invokes ServeConn in a go statement.
+func ServeConn(conn io.ReadWriteCloser, opts *Options) {
+	rpc.ServeCodec(NewServerCodec(conn, opts))
+}
@@ -0,0 +1,183 @@
+package binrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	rpc "github.com/lijie/go/rpc"
+)
+
+type Pair struct {
+	A, B int32
+}
+
+func sum(ctx context.Context, arg *Pair, reply *int32) error {
+	if arg.A < 0 {
+		return rpc.Error(7)
+	}
+	*reply = arg.A + arg.B
+	return nil
+}
+
+func newServer(t *testing.T) *rpc.Server {
+	server := rpc.NewServer()
+	if err := server.Register(10, sum); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestClientServer(t *testing.T) {
+	opts := &Options{ByteOrder: binary.LittleEndian}
+	cli, srv := net.Pipe()
+	go newServer(t).ServeCodec(context.Background(), NewServerCodec(srv, opts))
+	c := NewClient(cli, opts)
+	defer c.Close()
+
+	var reply int32
+	if err := c.Call(10, &Pair{3, 4}, &reply); err != nil || reply != 7 {
+		t.Fatal("call:", reply, err)
+	}
+	if err := c.Call(10, &Pair{-1, 4}, &reply); err != rpc.Error(7) {
+		t.Fatal("failing call returned", err)
+	}
+	// The codec has no room for metadata, which is dropped.
+	ctx := rpc.WithMetadata(context.Background(), rpc.Metadata{"user": "bob"})
+	if err := c.CallContext(ctx, 10, &Pair{1, 1}, &reply); err != nil || reply != 2 {
+		t.Fatal("call with metadata:", reply, err)
+	}
+}
+
+// TestWireFormat plays a legacy peer writing raw big-endian frames.
+func TestWireFormat(t *testing.T) {
+	cli, srv := net.Pipe()
+	go newServer(t).ServeCodec(context.Background(), NewServerCodec(srv, nil))
+	defer cli.Close()
+
+	req := []byte{
+		0, 0, 0, 20, // length
+		0, 0, 0, 10, // cmd
+		0, 0, 0, 9, // seq
+		0, 0, 0, 0, // error
+		0, 0, 0, 5, // A
+		0, 0, 0, 6, // B
+	}
+	if _, err := cli.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 20)
+	if _, err := io.ReadFull(cli, resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0, 0, 0, 16,
+		0, 0, 0, 10,
+		0, 0, 0, 9,
+		0, 0, 0, 0,
+		0, 0, 0, 11,
+	}
+	if string(resp) != string(want) {
+		t.Fatalf("response frame % x, want % x", resp, want)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(11, func(ctx context.Context, n *int32, reply *[]byte) error {
+		*reply = bytes.Repeat([]byte("binrpc "), int(*n))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Compression: &rpc.Compression{Algorithm: rpc.Flate}}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(context.Background(), NewServerCodec(srv, opts))
+	c := NewClient(cli, opts)
+	defer c.Close()
+
+	var reply []byte
+	n := int32(1000)
+	if err := c.Call(11, &n, &reply); err != nil || !bytes.Equal(reply, bytes.Repeat([]byte("binrpc "), 1000)) {
+		t.Fatal("call:", len(reply), err)
+	}
+}
+
+// TestFrameTooLarge checks that lengths close to the uint32 limit do not
+// wrap around the frame size check.
+func TestFrameTooLarge(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	codec := NewServerCodec(srv, nil)
+	defer codec.Close()
+	go cli.Write([]byte{
+		0xff, 0xff, 0xff, 0xff, // length
+		0, 0, 0, 10, // cmd
+		0, 0, 0, 1, // seq
+		0, 0, 0, 0, // error
+	})
+	var req rpc.Request
+	if err := codec.ReadRequestHeader(&req); err != errFrameTooLarge {
+		t.Fatalf("ReadRequestHeader returned %v, want %v", err, errFrameTooLarge)
+	}
+}
+
+func TestUnencodableReply(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(10, sum); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(12, func(ctx context.Context, arg *Pair, reply *int) error {
+		*reply = int(arg.A)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(13, func(ctx context.Context, n *int32, reply *[]byte) error {
+		*reply = make([]byte, *n)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{MaxFrameSize: 64}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(context.Background(), NewServerCodec(srv, opts))
+	c := NewClient(cli, opts)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var n int
+	if err := c.CallContext(ctx, 12, &Pair{1, 2}, &n); err != rpc.ErrInternal {
+		t.Fatal("unencodable reply returned", err)
+	}
+	var b []byte
+	size := int32(100)
+	if err := c.CallContext(ctx, 13, &size, &b); err != rpc.ErrInternal {
+		t.Fatal("oversized reply returned", err)
+	}
+	var reply int32
+	if err := c.CallContext(ctx, 10, &Pair{3, 4}, &reply); err != nil || reply != 7 {
+		t.Fatal("next call:", reply, err)
+	}
+}
+
+func TestNewServerTypeCheck(t *testing.T) {
+	server := NewServer(nil)
+	if err := server.Register(10, sum); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(11, func(ctx context.Context, arg *[]byte, reply *[]byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(12, func(ctx context.Context, arg *Pair, reply *int) error { return nil }); err == nil {
+		t.Fatal("registered a handler replying *int")
+	}
+	if err := server.Register(13, func(ctx context.Context, arg *string, reply *int32) error { return nil }); err == nil {
+		t.Fatal("registered a handler taking *string")
+	}
+}
@@ -6,14 +6,17 @@ package rpc
 
 import (
 	"bufio"
+	"context"
 	"encoding/gob"
 	"errors"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,7 +39,16 @@ type Call struct {
 	Reply interface{} // The reply from the function (*struct).
 	Error error       // After completion, the error status.
 	Done  chan *Call  // Strobes when call is complete.
-	timer *time.Timer
+	// Metadata is sent with the call, along with the metadata of its
+	// context; see WithMetadata.
+	Metadata Metadata
+	// ReplyMetadata is the metadata the server sent with the reply.
+	ReplyMetadata Metadata
+
+	peer   net.Addr           // server of the last attempt, set for interceptors
+	ctx    context.Context    // bounds the call, nil for no limit
+	stop   func() bool        // stops the watch on ctx
+	cancel context.CancelFunc // releases ctx if the call created it
 }
 
 // Client represents an RPC Client.
@@ -49,12 +61,36 @@ type Client struct {
 	reqMutex sync.Mutex // protects following
 	request  Request
 
-	mutex    sync.Mutex // protects following
-	seq      uint32
-	pending  map[uint32]*Call
-	ntf      map[uint32]reflect.Type
-	closing  bool // user has called Close
-	shutdown bool // server has told us to stop
+	mutex        sync.Mutex // protects following
+	seq          uint32
+	pending      map[uint32]*Call
+	ntf          map[uint32]*notifier
+	streams      map[uint32]clientStream
+	interceptors []ClientInterceptor
+	closing      bool // user has called Close
+	shutdown     bool // server has told us to stop
+
+	dead     chan struct{} // closed once input has failed the pending calls
+	closed   chan struct{} // closed by Close
+	closeErr error         // fails the pending calls if set before the codec is closed; protected by mutex
+	watchdog *watchdog     // protected by mutex
+	started  time.Time
+	hello    chan struct{} // closed once the protocol version is known
+	greet    sync.Once     // sends the hello
+	helloSeq uint32        // seq of the hello until it is answered, 0 otherwise; protected by mutex
+	version  uint32        // protocol version agreed with the server, protected by mutex
+	replied  int32         // non-zero once a call or stream got a response, accessed atomically
+}
+
+// A NotifyHandler receives notifications pushed by the server.  body is a
+// pointer to a freshly decoded value of the type registered with OnNotify,
+// or nil if it was registered with a nil body.  Handlers run on the goroutine reading responses, so they must not block;
+// in particular they must not make synchronous calls on the same Client.
+type NotifyHandler func(cmd uint32, body interface{})
+
+type notifier struct {
+	typ     reflect.Type
+	handler NotifyHandler
 }
 
 // A ClientCodec implements writing of RPC requests and
@@ -86,15 +122,27 @@ func (client *Client) send(call *Call) {
 		call.done()
 		return
 	}
-	seq := client.seq
+	var timeout uint32
+	if call.ctx != nil {
+		if call.ctx.Err() != nil {
+			call.Error = context.Cause(call.ctx)
+			client.mutex.Unlock()
+			call.done()
+			return
+		}
+		timeout = timeoutMillis(call.ctx)
+	}
+	seq := client.nextSeq()
 	call.Seq = seq
-	client.seq++
 	client.pending[seq] = call
+	var md Metadata
+	if client.version >= 1 {
+		md = call.Metadata
+	}
 	client.mutex.Unlock()
 
 	// Encode and send the request.
-	client.request.Seq = seq
-	client.request.Cmd = call.Cmd
+	client.request = Request{Cmd: call.Cmd, Seq: seq, Timeout: timeout, Metadata: md}
 	err := client.codec.WriteRequest(&client.request, call.Args)
 	if err != nil {
 		client.mutex.Lock()
@@ -108,6 +156,74 @@ func (client *Client) send(call *Call) {
 	}
 }
 
+// timeoutMillis returns the time left until the deadline of ctx in
+// milliseconds, rounded up, or 0 if ctx has no deadline.
+func timeoutMillis(ctx context.Context) uint32 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return 1
+	}
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	if ms > math.MaxUint32 {
+		return 0
+	}
+	return uint32(ms)
+}
+
+// abort completes call with the cause of its context being done, unless the
+// reply is already being delivered, and tells the server to stop working
+// on it.  Once abort has removed the call from pending, input discards the
+// reply, so it is never decoded into call.Reply.
+func (client *Client) abort(call *Call) {
+	client.mutex.Lock()
+	if client.pending[call.Seq] != call {
+		// Not sent yet, already completed, or input is decoding the reply.
+		client.mutex.Unlock()
+		return
+	}
+	delete(client.pending, call.Seq)
+	client.mutex.Unlock()
+
+	call.Error = context.Cause(call.ctx)
+	client.reqMutex.Lock()
+	client.request = Request{Cmd: call.Cmd, Seq: call.Seq, Kind: KindCancel}
+	err := client.codec.WriteRequest(&client.request, invalidRequest)
+	client.reqMutex.Unlock()
+	if debugLog && err != nil {
+		log.Println("rpc: writing cancel:", err)
+	}
+	call.done()
+}
+
+// nextSeq returns the next free sequence number.  Seq 0 is reserved for
+// notifications, and once the counter has wrapped around, numbers still
+// held by pending calls are skipped so that a long-lived connection never
+// confuses the reply of an old call with a new one.
+// client.mutex must be held.
+func (client *Client) nextSeq() uint32 {
+	for {
+		seq := client.seq
+		client.seq++
+		if seq == 0 {
+			continue
+		}
+		if _, ok := client.pending[seq]; ok {
+			continue
+		}
+		if _, ok := client.streams[seq]; ok {
+			continue
+		}
+		if seq == client.helloSeq {
+			continue
+		}
+		return seq
+	}
+}
+
 func (client *Client) input() {
 	var err error
 	var response Response
@@ -117,23 +233,75 @@ func (client *Client) input() {
 		if err != nil {
 			break
 		}
-		seq := response.Seq
 		client.mutex.Lock()
-		call := client.pending[seq]
-		delete(client.pending, seq)
+		wd := client.watchdog
 		client.mutex.Unlock()
+		if wd != nil {
+			wd.read()
+		}
+		if response.Kind == KindHello {
+			err = client.codec.ReadResponseBody(nil)
+			client.negotiated(response.Version)
+			continue
+		}
+		if client.helloReply(&response) {
+			// A server that predates KindHello took the hello for a
+			// call to cmd 0.
+			err = client.codec.ReadResponseBody(nil)
+			client.negotiated(0)
+			continue
+		}
+		if response.Seq != 0 {
+			atomic.StoreInt32(&client.replied, 1)
+		}
+		if response.Kind == KindPing || response.Kind == KindPong {
+			err = client.codec.ReadResponseBody(nil)
+			if err == nil && response.Kind == KindPing {
+				// Not from this goroutine: the server may be blocked
+				// writing to us.
+				go client.writeFrame(Request{Kind: KindPong}, invalidRequest)
+			}
+			continue
+		}
+		seq := response.Seq
+		var call *Call
+		var stream clientStream
+		if seq != 0 {
+			client.mutex.Lock()
+			call = client.pending[seq]
+			if call != nil {
+				delete(client.pending, seq)
+			} else {
+				stream = client.streams[seq]
+			}
+			client.mutex.Unlock()
+		}
 
 		switch {
+		case stream != nil:
+			err = stream.frame(&response)
 		case seq == 0:
-			if ntf_typ, ok := client.ntf[response.Cmd]; ok {
-				ntf_val := reflect.New(ntf_typ)
-				err = client.codec.ReadResponseBody(ntf_val)
+			client.mutex.Lock()
+			ntf := client.ntf[response.Cmd]
+			client.mutex.Unlock()
+			if ntf == nil {
+				// unknown ntf, just discard...
+				err = client.codec.ReadResponseBody(nil)
 				if err != nil {
-					err = errors.New("reading error ntf body: " + err.Error())
+					err = errors.New("reading ntf body: " + err.Error())
 				}
-			} else {
-				// unknow ntf, just discard...
+				break
 			}
+			var body interface{}
+			if ntf.typ != nil {
+				body = reflect.New(ntf.typ).Interface()
+			}
+			err = client.codec.ReadResponseBody(body)
+			if err != nil {
+				err = errors.New("reading ntf body: " + err.Error())
+				break
+			}
+			ntf.handler(response.Cmd, body)
 		case call == nil:
 			// We've got no pending call. That usually means that
 			// WriteRequest partially failed, and call was already
@@ -148,13 +316,14 @@ func (client *Client) input() {
 			// We've got an error response. Give this to the request;
 			// any subsequent requests will get the ReadResponseBody
 			// error if there is one.
-			call.Error = Error(response.Error)
-			err = client.codec.ReadResponseBody(nil)
+			call.ReplyMetadata = response.Metadata
+			call.Error, err = client.readError(&response)
 			if err != nil {
 				err = errors.New("reading error body: " + err.Error())
 			}
 			call.done()
 		default:
+			call.ReplyMetadata = response.Metadata
 			err = client.codec.ReadResponseBody(call.Reply)
 			if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
@@ -167,7 +336,9 @@ func (client *Client) input() {
 	client.mutex.Lock()
 	client.shutdown = true
 	closing := client.closing
-	if err == io.EOF {
+	if client.closeErr != nil {
+		err = client.closeErr
+	} else if err == io.EOF {
 		if closing {
 			err = ErrShutdown
 		} else {
@@ -178,7 +349,18 @@ func (client *Client) input() {
 		call.Error = err
 		call.done()
 	}
+	streams := client.streams
+	client.streams = nil
+	if client.watchdog != nil {
+		client.watchdog.stop()
+		client.watchdog = nil
+	}
 	client.mutex.Unlock()
+	for _, s := range streams {
+		s.fail(err)
+	}
+	client.negotiated(0)
+	close(client.dead)
 	client.reqMutex.Unlock()
 	if debugLog && err != io.EOF && !closing {
 		log.Println("rpc: client protocol error:", err)
@@ -186,8 +368,11 @@ func (client *Client) input() {
 }
 
 func (call *Call) done() {
-	if call.timer != nil {
-		call.timer.Stop()
+	if call.stop != nil {
+		call.stop()
+	}
+	if call.cancel != nil {
+		call.cancel()
 	}
 	select {
 	case call.Done <- call:
@@ -217,7 +402,12 @@ func NewClientWithCodec(codec ClientCodec) *Client {
 	client := &Client{
 		codec:   codec,
 		pending: make(map[uint32]*Call),
-		ntf:     make(map[uint32]reflect.Type),
+		ntf:     make(map[uint32]*notifier),
+		streams: make(map[uint32]clientStream),
+		dead:    make(chan struct{}),
+		closed:  make(chan struct{}),
+		started: time.Now(),
+		hello:   make(chan struct{}),
 	}
 	go client.input()
 	return client
@@ -248,6 +438,13 @@ func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
 	return c.dec.Decode(body)
 }
 
+func (c *gobClientCodec) RemoteAddr() net.Addr {
+	if conn, ok := c.rwc.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
 func (c *gobClientCodec) Close() error {
 	return c.rwc.Close()
 }
@@ -261,11 +458,16 @@ func DialHTTP(network, address string) (*Client, error) {
 // DialHTTPPath connects to an HTTP RPC server
 // at the specified network address and path.
 func DialHTTPPath(network, address, path string) (*Client, error) {
-	var err error
 	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
+	return connectHTTP(conn, network, address, path)
+}
+
+// connectHTTP asks the HTTP server at the other end of conn to switch it
+// to the RPC protocol, and returns a client on it.
+func connectHTTP(conn net.Conn, network, address, path string) (*Client, error) {
 	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
 
 	// Require successful HTTP response
@@ -295,6 +497,15 @@ func Dial(network, address string) (*Client, error) {
 	return NewClient(conn), nil
 }
 
+// RemoteAddr returns the address of the server, or nil if the codec does
+// not know it.
+func (client *Client) RemoteAddr() net.Addr {
+	if ra, ok := client.codec.(interface{ RemoteAddr() net.Addr }); ok {
+		return ra.RemoteAddr()
+	}
+	return nil
+}
+
 func (client *Client) Close() error {
 	client.mutex.Lock()
 	if client.closing {
@@ -302,6 +513,7 @@ func (client *Client) Close() error {
 		return ErrShutdown
 	}
 	client.closing = true
+	close(client.closed)
 	client.mutex.Unlock()
 	return client.codec.Close()
 }
@@ -311,6 +523,36 @@ func (client *Client) Close() error {
 // the same Call object.  If done is nil, Go will allocate a new channel.
 // If non-nil, done must be buffered or Go will deliberately crash.
 func (client *Client) Go(cmd uint32, args interface{}, reply interface{}, done chan *Call) *Call {
+	return client.goContext(nil, nil, cmd, args, reply, done)
+}
+
+// GoContext is like Go but the call is bounded by ctx.  The deadline of ctx
+// is sent to the server, which runs the handler with a context carrying the
+// same deadline.  If ctx is done before the reply arrives, the call
+// completes with the cause of ctx and the server is told to cancel the
+// handler's context; a reply arriving afterwards is discarded and never
+// decoded into reply.
+func (client *Client) GoContext(ctx context.Context, cmd uint32, args interface{}, reply interface{}, done chan *Call) *Call {
+	return client.goContext(ctx, nil, cmd, args, reply, done)
+}
+
+func (client *Client) goContext(ctx context.Context, cancel context.CancelFunc, cmd uint32, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := newCall(cmd, args, reply, done)
+	call.cancel = cancel
+
+	client.mutex.Lock()
+	interceptors := client.interceptors
+	client.mutex.Unlock()
+	if len(interceptors) > 0 {
+		go client.intercept(ctx, call, interceptors)
+		return call
+	}
+	client.start(ctx, call)
+	return call
+}
+
+// newCall returns a call to be completed on done, allocating done if nil.
+func newCall(cmd uint32, args interface{}, reply interface{}, done chan *Call) *Call {
 	call := new(Call)
 	call.Cmd = cmd
 	call.Args = args
@@ -327,56 +569,156 @@ func (client *Client) Go(cmd uint32, args interface{}, reply interface{}, done c
 		}
 	}
 	call.Done = done
-	client.send(call)
 	return call
 }
 
-func (client *Client) GoWithTimeout(cmd uint32, args interface{}, reply interface{}, done chan *Call, d time.Duration) *Call {
-	call := client.Go(cmd, args, reply, done)
-	call.timer = time.AfterFunc(d, func() {
-		var ok bool
-		// delete pending call
-		client.mutex.Lock()
-		if _, ok = client.pending[call.Seq]; ok {
-			delete(client.pending, call.Seq)
-		}
-		client.mutex.Unlock()
-		if ok {
-			call.Error = ErrTimeout
-			call.done()
+// start sends call, bounded by ctx.  The first call carrying metadata
+// sends the hello, and calls carrying metadata are sent once the protocol
+// version is known, so that the metadata is not sent to a server that
+// predates it.  A call still waiting for the answer when ctx is done or
+// the client shuts down fails without being sent.
+func (client *Client) start(ctx context.Context, call *Call) {
+	if ctx != nil {
+		call.Metadata = outgoingMetadata(ctx).merge(call.Metadata)
+	}
+	if len(call.Metadata) > 0 {
+		select {
+		case <-client.hello:
+		default:
+			go func() {
+				client.greet.Do(client.handshake)
+				var done <-chan struct{}
+				if ctx != nil {
+					done = ctx.Done()
+				}
+				select {
+				case <-client.hello:
+				case <-done:
+				case <-client.closed:
+				case <-client.dead:
+				}
+				// send fails the call if ctx is done or the client
+				// is shut down.
+				client.send(client.watch(ctx, call))
+			}()
+			return
 		}
-	})
+	}
+	client.send(client.watch(ctx, call))
+}
+
+// watch arranges for call to be aborted when ctx is done, and returns it.
+func (client *Client) watch(ctx context.Context, call *Call) *Call {
+	if ctx != nil && ctx.Done() != nil {
+		call.ctx = ctx
+		call.stop = context.AfterFunc(ctx, func() { client.abort(call) })
+	}
 	return call
 }
 
+// intercept runs call through the interceptor chain and completes it with
+// the error the chain returns.
+func (client *Client) intercept(ctx context.Context, call *Call, interceptors []ClientInterceptor) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	invoker := client.invoke
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		invoker = chainClient(interceptors[i], invoker)
+	}
+	call.Error = invoker(ctx, call)
+	call.done()
+}
+
+// invoke is the innermost Invoker: it sends one attempt of call and waits
+// for it to complete.
+func (client *Client) invoke(ctx context.Context, call *Call) error {
+	attempt := &Call{Cmd: call.Cmd, Args: call.Args, Reply: call.Reply, Metadata: call.Metadata, Done: make(chan *Call, 1)}
+	client.start(ctx, attempt)
+	<-attempt.Done
+	call.Seq = attempt.Seq
+	call.ReplyMetadata = attempt.ReplyMetadata
+	call.peer = client.RemoteAddr()
+	return attempt.Error
+}
+
+func chainClient(interceptor ClientInterceptor, next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) error {
+		return interceptor(ctx, call, next)
+	}
+}
+
+// An Invoker sends call to the server, waits for it to complete and
+// returns its error.  It may be invoked more than once for the same call,
+// for instance to retry it; call.Seq holds the seq of the last attempt.
+type Invoker func(ctx context.Context, call *Call) error
+
+// A ClientInterceptor wraps every call made through a Client, whether with
+// Go, Call or their context and timeout variants.  It may inspect or
+// change the call and ctx, invoke next any number of times, or not at all.
+// The error it returns becomes call.Error.
+//
+// Interceptors run on their own goroutine for asynchronous calls, so they
+// may block.
+type ClientInterceptor func(ctx context.Context, call *Call, next Invoker) error
+
+// Use appends interceptors to the chain wrapping every call made through
+// the client.  The first interceptor added is the outermost one.
+func (client *Client) Use(interceptors ...ClientInterceptor) {
+	client.mutex.Lock()
+	client.interceptors = append(client.interceptors[:len(client.interceptors):len(client.interceptors)], interceptors...)
+	client.mutex.Unlock()
+}
+
+// GoWithTimeout is like Go but the call fails with ErrTimeout if the reply
+// does not arrive within d.
+func (client *Client) GoWithTimeout(cmd uint32, args interface{}, reply interface{}, done chan *Call, d time.Duration) *Call {
+	ctx, cancel := context.WithTimeoutCause(context.Background(), d, ErrTimeout)
+	return client.goContext(ctx, cancel, cmd, args, reply, done)
+}
+
 // Call invokes the named function, waits for it to complete, and returns its error status.
 func (client *Client) Call(cmd uint32, args interface{}, reply interface{}) error {
 	call := <-client.Go(cmd, args, reply, make(chan *Call, 1)).Done
 	return call.Error
 }
 
+// CallContext invokes the named function, waits for it to complete, and
+// returns its error status.  See GoContext for how ctx bounds the call.
+func (client *Client) CallContext(ctx context.Context, cmd uint32, args interface{}, reply interface{}) error {
+	call := <-client.GoContext(ctx, cmd, args, reply, make(chan *Call, 1)).Done
+	return call.Error
+}
+
 // Call invokes the named function, waits for it to complete, and returns its error status.
 // If timeout occurs, it returns ErrTimeout
 func (client *Client) CallWithTimeout(cmd uint32, args interface{}, reply interface{}, d time.Duration) error {
-	call := client.Go(cmd, args, reply, make(chan *Call, 1))
-	call.timer = time.NewTimer(d)
+	call := <-client.GoWithTimeout(cmd, args, reply, make(chan *Call, 1), d).Done
+	return call.Error
+}
 
-	var err error
-	select {
-	case call = <-call.Done:
-		err = call.Error
-	case _ = <-call.timer.C:
-		err = ErrTimeout
-		// delete pending call
-		client.mutex.Lock()
-		delete(client.pending, call.Seq)
-		client.mutex.Unlock()
+// OnNotify registers handler to be called for every notification the
+// server pushes with the given cmd.  body is a sample of the notification
+// body, either a value or a pointer; each notification is decoded into a
+// new value of that type and handed to handler as a pointer.  If body is
+// nil, the notification body is discarded and handler gets a nil body.  A
+// nil handler removes the registration, after which such notifications
+// are discarded.
+func (client *Client) OnNotify(cmd uint32, body interface{}, handler NotifyHandler) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if handler == nil {
+		delete(client.ntf, cmd)
+		return
 	}
-
-	return err
+	client.ntf[cmd] = &notifier{typ: notifyType(body), handler: handler}
 }
 
-func (client *Client) OnNotify(cmd uint32, reply interface{}) {
-	typ := reflect.TypeOf(reply)
-	client.ntf[cmd] = typ
+// notifyType returns the type notifications registered with body are
+// decoded into, nil if they are discarded.
+func notifyType(body interface{}) reflect.Type {
+	if body == nil {
+		return nil
+	}
+	return elemType(body)
 }
@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientInterceptors(t *testing.T) {
+	server := NewServer()
+	var attempts int32
+	flaky := func(ctx context.Context, arg int, reply *int) error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return Error(503)
+		}
+		*reply = arg * 2
+		return nil
+	}
+	if err := server.Register(1, flaky); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(101, Fail); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+
+	type record struct {
+		cmd     uint32
+		err     error
+		latency time.Duration
+	}
+	records := make(chan record, 10)
+	c.Use(func(ctx context.Context, call *Call, next Invoker) error {
+		start := time.Now()
+		err := next(ctx, call)
+		records <- record{call.Cmd, err, time.Since(start)}
+		return err
+	}, func(ctx context.Context, call *Call, next Invoker) error {
+		// Retry unavailable errors.
+		for {
+			err := next(ctx, call)
+			if err != Error(503) {
+				return err
+			}
+		}
+	})
+
+	reply := 0
+	call := <-c.Go(1, 21, &reply, nil).Done
+	if call.Error != nil || reply != 42 {
+		t.Fatal("retried call:", reply, call.Error)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatal("attempts:", n)
+	}
+	if r := <-records; r.cmd != 1 || r.err != nil || r.latency <= 0 {
+		t.Fatal("interceptor saw", r)
+	}
+
+	if err := c.CallWithTimeout(101, &AddParams{1, 2}, &reply, time.Second); err != Error(777) {
+		t.Fatal("failing call returned", err)
+	}
+	if r := <-records; r.cmd != 101 || r.err != Error(777) {
+		t.Fatal("interceptor saw", r)
+	}
+}
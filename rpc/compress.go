@@ -0,0 +1,426 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CompressionAlgorithm is the algorithm compressing the data sent on a
+// connection.
+type CompressionAlgorithm uint8
+
+const (
+	NoCompression CompressionAlgorithm = iota
+	Flate                              // compress/flate
+	Gzip                               // compress/gzip
+)
+
+// DefaultCompressionThreshold is the size below which writes are sent
+// uncompressed if Compression.Threshold is 0.
+const DefaultCompressionThreshold = 512
+
+// Compression configures the compression of the data one side of a
+// connection sends.  Each side picks its own; the zero value sends data
+// uncompressed.
+type Compression struct {
+	Algorithm CompressionAlgorithm
+	Level     int // compress/flate level, flate.DefaultCompression if 0
+	Threshold int // writes shorter than this are sent uncompressed, DefaultCompressionThreshold if 0
+}
+
+// CompressionStats counts the bytes going through a CompressedConn.  Raw
+// bytes are those of the codec, wire bytes those of the connection.
+type CompressionStats struct {
+	RawOut, WireOut uint64
+	RawIn, WireIn   uint64
+}
+
+// Ratio returns the compression ratio achieved on the data sent, RawOut
+// over WireOut, or 1 if nothing was sent.
+func (s CompressionStats) Ratio() float64 {
+	if s.WireOut == 0 {
+		return 1
+	}
+	return float64(s.RawOut) / float64(s.WireOut)
+}
+
+// compressionCounters are CompressionStats updated atomically.
+type compressionCounters struct {
+	rawOut, wireOut, rawIn, wireIn uint64
+}
+
+func (c *compressionCounters) stats() CompressionStats {
+	return CompressionStats{
+		RawOut:  atomic.LoadUint64(&c.rawOut),
+		WireOut: atomic.LoadUint64(&c.wireOut),
+		RawIn:   atomic.LoadUint64(&c.rawIn),
+		WireIn:  atomic.LoadUint64(&c.wireIn),
+	}
+}
+
+// compressionMagic opens the data of both sides of a compressed
+// connection.  No gob stream starts with 0xf0.  Read as a binrpc frame
+// length it is 0xf0525a01 big-endian and 0x015a52f0 little-endian, both
+// over binrpc.DefaultMaxFrameSize, but a peer with a raised MaxFrameSize
+// may send a first frame of that length.  Servers only look for the magic
+// once compression is enabled, so that those leaving it off never mistake
+// such a frame for it.
+var compressionMagic = [4]byte{0xf0, 'R', 'Z', 1}
+
+// maxCompressedFrame bounds the size of a frame, compressed or not.
+const maxCompressedFrame = 1 << 20
+
+var errCompressedFrame = errors.New("rpc: invalid compressed frame")
+
+// A CompressedConn compresses the data written to a connection and
+// decompresses the data read from it.  Once both sides have sent
+// compressionMagic, the data is sent in frames, each holding one write:
+// a byte giving the CompressionAlgorithm of the frame, the length of the
+// payload as a uvarint, and the payload.
+//
+// The client side, returned by CompressConn, sends the magic first.  The
+// server side, returned by AcceptCompression, answers it, or passes the
+// data through untouched if the client did not send it.
+type CompressedConn struct {
+	net.Conn
+	opts   Compression
+	r      *bufio.Reader
+	shared *compressionCounters // also updated if not nil
+	stats  compressionCounters
+
+	ready     chan struct{} // closed once framed is known
+	framed    bool
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Owned by the reading goroutine.
+	greeted bool   // the magic of the peer has been read
+	pending []byte // decompressed data not read yet
+	frame   []byte
+	inflate io.ReadCloser
+	gunzip  *gzip.Reader
+
+	wmu     sync.Mutex // protects following
+	sent    bool       // the magic has been written
+	out     bytes.Buffer
+	zbuf    bytes.Buffer
+	deflate *flate.Writer
+	gzip    *gzip.Writer
+}
+
+// rwcConn gives a connection that is not a net.Conn the methods it lacks.
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+func (rwcConn) LocalAddr() net.Addr                { return nil }
+func (rwcConn) RemoteAddr() net.Addr               { return nil }
+func (rwcConn) SetDeadline(t time.Time) error      { return errors.New("rpc: deadlines not supported") }
+func (rwcConn) SetReadDeadline(t time.Time) error  { return errors.New("rpc: deadlines not supported") }
+func (rwcConn) SetWriteDeadline(t time.Time) error { return errors.New("rpc: deadlines not supported") }
+
+func newCompressedConn(conn io.ReadWriteCloser, opts Compression) *CompressedConn {
+	nc, ok := conn.(net.Conn)
+	if !ok {
+		nc = rwcConn{conn}
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultCompressionThreshold
+	}
+	if opts.Level == 0 || opts.Level < flate.HuffmanOnly || opts.Level > flate.BestCompression {
+		opts.Level = flate.DefaultCompression
+	}
+	return &CompressedConn{
+		Conn:   nc,
+		opts:   opts,
+		r:      bufio.NewReader(nc),
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// CompressConn returns the client side of a compressed connection, to be
+// used with NewClient or another client codec.  The server must serve it
+// with ServeConn, or with a codec reading from AcceptCompression.
+func CompressConn(conn io.ReadWriteCloser, opts Compression) *CompressedConn {
+	c := newCompressedConn(conn, opts)
+	c.framed = true
+	close(c.ready)
+	return c
+}
+
+// AcceptCompression returns the server side of a connection whose client
+// may have wrapped it with CompressConn.  opts configures the compression
+// of the data sent to such clients.  Writes wait for the client to send
+// its first bytes, which tell whether it compresses, so notifications
+// and pings cannot go out before that.
+func AcceptCompression(conn io.ReadWriteCloser, opts Compression) *CompressedConn {
+	return newCompressedConn(conn, opts)
+}
+
+// Stats returns the byte counts of the connection.
+func (c *CompressedConn) Stats() CompressionStats {
+	return c.stats.stats()
+}
+
+// greet reads the magic of the peer.  On the server side, it finds out
+// whether the client compresses.
+func (c *CompressedConn) greet() error {
+	c.greeted = true
+	b, err := c.r.Peek(len(compressionMagic))
+	match := err == nil && bytes.Equal(b, compressionMagic[:])
+	select {
+	case <-c.ready:
+		// The client side: the server must answer with the magic.
+		if !match {
+			if err == nil {
+				err = errors.New("rpc: server does not support compression")
+			}
+			return err
+		}
+	default:
+		c.framed = match
+		close(c.ready)
+		if !match {
+			return nil
+		}
+	}
+	c.r.Discard(len(compressionMagic))
+	c.count(0, 0, 0, uint64(len(compressionMagic)))
+	return nil
+}
+
+func (c *CompressedConn) count(rawOut, wireOut, rawIn, wireIn uint64) {
+	for _, s := range []*compressionCounters{&c.stats, c.shared} {
+		if s != nil {
+			// stats loads the raw counts first, so that they never
+			// run ahead of the wire counts.
+			atomic.AddUint64(&s.wireOut, wireOut)
+			atomic.AddUint64(&s.rawOut, rawOut)
+			atomic.AddUint64(&s.wireIn, wireIn)
+			atomic.AddUint64(&s.rawIn, rawIn)
+		}
+	}
+}
+
+func (c *CompressedConn) Read(p []byte) (int, error) {
+	if !c.greeted {
+		if err := c.greet(); err != nil {
+			return 0, err
+		}
+	}
+	if !c.framed {
+		n, err := c.r.Read(p)
+		c.count(0, 0, uint64(n), uint64(n))
+		return n, err
+	}
+	for len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads the next frame into pending.
+func (c *CompressedConn) readFrame() error {
+	alg, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil || size > maxCompressedFrame {
+		return unexpectedEOF(err)
+	}
+	if uint64(cap(c.frame)) < size {
+		c.frame = make([]byte, size)
+	}
+	c.frame = c.frame[:size]
+	if _, err = io.ReadFull(c.r, c.frame); err != nil {
+		return unexpectedEOF(err)
+	}
+	var uvarint [binary.MaxVarintLen64]byte
+	wire := 1 + uint64(binary.PutUvarint(uvarint[:], size)) + size
+	var zr io.Reader
+	switch CompressionAlgorithm(alg) {
+	case NoCompression:
+		c.pending = c.frame
+		c.count(0, 0, size, wire)
+		return nil
+	case Flate:
+		if c.inflate == nil {
+			c.inflate = flate.NewReader(bytes.NewReader(c.frame))
+		} else if err = c.inflate.(flate.Resetter).Reset(bytes.NewReader(c.frame), nil); err != nil {
+			return err
+		}
+		zr = c.inflate
+	case Gzip:
+		if c.gunzip == nil {
+			c.gunzip, err = gzip.NewReader(bytes.NewReader(c.frame))
+		} else {
+			err = c.gunzip.Reset(bytes.NewReader(c.frame))
+		}
+		if err != nil {
+			return err
+		}
+		zr = c.gunzip
+	default:
+		return errCompressedFrame
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(zr, maxCompressedFrame+1))
+	if err != nil {
+		return err
+	}
+	if n > maxCompressedFrame {
+		return errCompressedFrame
+	}
+	c.pending = buf.Bytes()
+	c.count(0, 0, uint64(n), wire)
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	switch err {
+	case nil:
+		return errCompressedFrame
+	case io.EOF:
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *CompressedConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.ready:
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.framed {
+		n, err := c.Conn.Write(p)
+		c.count(uint64(n), uint64(n), 0, 0)
+		return n, err
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxCompressedFrame {
+			chunk = chunk[:maxCompressedFrame]
+		}
+		if err := c.writeFrame(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame writes p as one frame, compressed if that makes it smaller.
+func (c *CompressedConn) writeFrame(p []byte) error {
+	c.out.Reset()
+	if !c.sent {
+		c.sent = true
+		c.out.Write(compressionMagic[:])
+	}
+	alg, payload := NoCompression, p
+	if c.opts.Algorithm != NoCompression && len(p) >= c.opts.Threshold {
+		if z, err := c.compress(p); err == nil && len(z) < len(p) {
+			alg, payload = c.opts.Algorithm, z
+		}
+	}
+	c.out.WriteByte(byte(alg))
+	var n [binary.MaxVarintLen64]byte
+	c.out.Write(n[:binary.PutUvarint(n[:], uint64(len(payload)))])
+	c.out.Write(payload)
+	wire := c.out.Len()
+	_, err := c.Conn.Write(c.out.Bytes())
+	if err == nil {
+		c.count(uint64(len(p)), uint64(wire), 0, 0)
+	}
+	return err
+}
+
+// compress returns p compressed with the algorithm of the connection.
+func (c *CompressedConn) compress(p []byte) ([]byte, error) {
+	c.zbuf.Reset()
+	var w io.WriteCloser
+	switch c.opts.Algorithm {
+	case Flate:
+		if c.deflate == nil {
+			var err error
+			if c.deflate, err = flate.NewWriter(&c.zbuf, c.opts.Level); err != nil {
+				return nil, err
+			}
+		} else {
+			c.deflate.Reset(&c.zbuf)
+		}
+		w = c.deflate
+	case Gzip:
+		if c.gzip == nil {
+			var err error
+			if c.gzip, err = gzip.NewWriterLevel(&c.zbuf, c.opts.Level); err != nil {
+				return nil, err
+			}
+		} else {
+			c.gzip.Reset(&c.zbuf)
+		}
+		w = c.gzip
+	default:
+		return nil, errors.New("rpc: unknown compression algorithm")
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return c.zbuf.Bytes(), nil
+}
+
+// Close closes the underlying connection.
+func (c *CompressedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// SetCompression makes the connections served by ServeConn from then on
+// accept clients that wrap theirs with CompressConn, and sets the
+// compression of the data sent to them.  Such connections hold the
+// writes of the server until the client has sent its first bytes, see
+// AcceptCompression.  A nil c, the default, serves connections as is.
+func (server *Server) SetCompression(c *Compression) {
+	server.mu.Lock()
+	server.compression = c
+	server.mu.Unlock()
+}
+
+// CompressionStats returns the byte counts of all the connections served
+// by ServeConn with compression enabled, whether their client compresses
+// or not.
+func (server *Server) CompressionStats() CompressionStats {
+	return server.compressionStats.stats()
+}
+
+// DialCompressed connects to an RPC server at the specified network
+// address, compressing the data it sends with opts.
+func DialCompressed(network, address string, opts Compression) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(CompressConn(conn, opts)), nil
+}
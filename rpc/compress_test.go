@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func compressServer(t *testing.T, c Compression) *Server {
+	server := NewServer()
+	server.SetCompression(&c)
+	if err := Handle(server, 1, func(ctx context.Context, n int, reply *string) error {
+		*reply = strings.Repeat("compressible ", n)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// sentStats returns the byte counts of server once it has sent n bytes,
+// which it counts after the client may have read them.
+func sentStats(server *Server, n uint64) CompressionStats {
+	deadline := time.Now().Add(time.Second)
+	for {
+		s := server.CompressionStats()
+		if s.RawOut >= n && s.WireOut > 0 || time.Now().After(deadline) {
+			return s
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, alg := range []CompressionAlgorithm{Flate, Gzip} {
+		server := compressServer(t, Compression{Algorithm: alg})
+		cli, srv := net.Pipe()
+		go server.ServeConn(context.Background(), srv)
+		conn := CompressConn(cli, Compression{Algorithm: alg, Threshold: 64})
+		client := NewClient(conn)
+
+		for _, n := range []int{1, 1000} {
+			reply, err := Invoke[int, string](client, 1, n)
+			if err != nil || reply != strings.Repeat("compressible ", n) {
+				t.Fatalf("algorithm %d, call %d: %d bytes, %v", alg, n, len(reply), err)
+			}
+		}
+		in := conn.Stats()
+		if in.RawIn < 13000 || in.WireIn*4 > in.RawIn {
+			t.Errorf("algorithm %d: replies not compressed: %+v", alg, in)
+		}
+		client.Close()
+		if s := sentStats(server, 13000); s.Ratio() < 4 {
+			t.Errorf("algorithm %d: server ratio %.2f: %+v", alg, s.Ratio(), s)
+		}
+	}
+}
+
+// TestCompressionThreshold checks that writes below the threshold are
+// sent as is, with only the frame header added.
+func TestCompressionThreshold(t *testing.T) {
+	a, b := net.Pipe()
+	w := CompressConn(a, Compression{Algorithm: Flate, Threshold: 1000})
+	r := AcceptCompression(b, Compression{})
+	small := bytes.Repeat([]byte("x"), 999)
+	large := bytes.Repeat([]byte("x"), 1000)
+	done := make(chan struct{})
+	go func() {
+		w.Write(small)
+		w.Write(large)
+		close(done)
+	}()
+	buf := make([]byte, 2000)
+	for _, want := range [][]byte{small, large} {
+		n, err := r.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], want) {
+			t.Fatalf("read %d bytes, %v; want %d", n, err, len(want))
+		}
+	}
+	<-done
+	s := w.Stats()
+	if s.RawOut != 1999 {
+		t.Errorf("sent %d raw bytes, want 1999", s.RawOut)
+	}
+	// Magic, header and raw payload for the first write.
+	if small := uint64(len(compressionMagic) + 3 + 999); s.WireOut <= small || s.WireOut > small+50 {
+		t.Errorf("sent %d bytes on the wire, want just over %d", s.WireOut, small)
+	}
+	if got, want := r.Stats(), (CompressionStats{RawIn: s.RawOut, WireIn: s.WireOut}); got != want {
+		t.Errorf("reader stats %+v, want %+v", got, want)
+	}
+	w.Close()
+	r.Close()
+}
+
+// TestCompressionPlainClient checks that a server set to compress still
+// serves clients that don't.
+func TestCompressionPlainClient(t *testing.T) {
+	server := compressServer(t, Compression{Algorithm: Gzip})
+	client := typedPair(server)
+	defer client.Close()
+	reply, err := Invoke[int, string](client, 1, 1000)
+	if err != nil || len(reply) != 13000 {
+		t.Fatalf("call: %d bytes, %v", len(reply), err)
+	}
+	if s := sentStats(server, 13000); s.RawOut != s.WireOut {
+		t.Errorf("server stats %+v, want uncompressed", s)
+	}
+}
+
+// TestCompressionOff checks that a server without compression writes to
+// a connection before the client has sent anything.
+func TestCompressionOff(t *testing.T) {
+	server := NewServer()
+	server.SetKeepalive(Keepalive{Interval: 10 * time.Millisecond})
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go server.ServeConn(context.Background(), srv)
+
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := cli.Read(make([]byte, 1)); err != nil {
+		t.Fatal("no ping before the first request:", err)
+	}
+	if s := server.CompressionStats(); s != (CompressionStats{}) {
+		t.Errorf("server stats %+v, want none", s)
+	}
+}
@@ -0,0 +1,318 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn represents a single connection served by ServeCodec.  It carries the
+// per-connection state of a stateful service: an ID unique within the
+// process, the peer address, a key/value store for per-login state and the
+// hooks to run when the connection goes away.
+//
+// A handler receives the Conn either as its first argument, when
+// registered as func(*Conn, *Args, *Reply) error, or from its context with
+// ConnFromContext.
+type Conn struct {
+	server  *Server
+	codec   ServerCodec
+	id      uint64
+	remote  net.Addr
+	tls     *tls.ConnectionState
+	start   time.Time
+	ctx     context.Context
+	cancel  context.CancelFunc
+	sending sync.Mutex // serializes writes to codec
+
+	wg sync.WaitGroup // in-flight calls
+
+	mu         sync.Mutex // protects following
+	inFlight   int
+	calls      map[uint32]context.CancelFunc // cancels in-flight calls by seq
+	streams    map[uint32]*ServerStream      // open streams by seq
+	duplexes   map[uint32]*Duplex            // open duplex streams by seq
+	values     map[interface{}]interface{}
+	closeHooks []func(*Conn)
+	closed     bool
+	version    uint32 // protocol version agreed with the client
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+type connKey struct{}
+
+var connID uint64
+
+// ConnFromContext returns the connection a handler's context belongs to,
+// or nil if ctx was not created by the server.
+func ConnFromContext(ctx context.Context) *Conn {
+	conn, _ := ctx.Value(connKey{}).(*Conn)
+	return conn
+}
+
+// ID returns the identifier of the connection, unique within the process.
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// RemoteAddr returns the address of the peer, or nil if the codec does not
+// know it.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Start returns the time the server started serving the connection.
+func (c *Conn) Start() time.Time {
+	return c.start
+}
+
+// Context returns the context of the connection.  It is cancelled once the
+// connection has been closed.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// Value returns the value stored under key, or nil.
+func (c *Conn) Value(key interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// SetValue stores val under key for the lifetime of the connection.
+func (c *Conn) SetValue(key, val interface{}) {
+	c.mu.Lock()
+	if c.values == nil {
+		c.values = make(map[interface{}]interface{})
+	}
+	c.values[key] = val
+	c.mu.Unlock()
+}
+
+// DeleteValue removes the value stored under key.
+func (c *Conn) DeleteValue(key interface{}) {
+	c.mu.Lock()
+	delete(c.values, key)
+	c.mu.Unlock()
+}
+
+// ConnValue returns the value stored in c under key if it has type T.
+func ConnValue[T any](c *Conn, key interface{}) (T, bool) {
+	v, ok := c.Value(key).(T)
+	return v, ok
+}
+
+// OnClose registers f to be called once the connection has been closed and
+// all its state is about to be dropped.  Hooks run in registration order on
+// the goroutine serving the connection.  If the connection is already
+// closed, f is called immediately.
+func (c *Conn) OnClose(f func(*Conn)) {
+	c.mu.Lock()
+	if !c.closed {
+		c.closeHooks = append(c.closeHooks, f)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	f(c)
+}
+
+// Notify pushes a notification to the peer.  The notification is written
+// as a Response with Seq 0 and the given cmd, followed by body, so the
+// client never mistakes it for the reply to a call.  A nil body sends a
+// notification without payload.  Notify is safe to call from any
+// goroutine, including from handlers serving the same connection.
+func (c *Conn) Notify(cmd uint32, body interface{}) error {
+	if body == nil {
+		body = invalidRequest
+	}
+	server := c.server
+	resp := server.getResponse()
+	resp.Cmd = cmd
+	resp.Seq = 0
+	c.sending.Lock()
+	err := c.codec.WriteResponse(resp, body)
+	c.sending.Unlock()
+	server.freeResponse(resp)
+	return err
+}
+
+// Close closes the underlying codec, which makes ServeCodec return.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.codec.Close()
+	})
+	return c.closeErr
+}
+
+// startCall accounts for a request about to be dispatched and returns the
+// context of the call, bounded by the timeout chosen by the client.  It
+// reports false if the server is shutting down and the request must be
+// refused; the request is accounted for all the same, so that the
+// connection stays open until it has been answered and ended with endCall.
+func (c *Conn) startCall(req *Request) (context.Context, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.server.shuttingDown() {
+		c.inFlight++
+		c.wg.Add(1)
+		return nil, false
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if req.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(c.ctx, time.Duration(req.Timeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(c.ctx)
+	}
+	if c.version >= 1 || req.Metadata != nil {
+		ctx = context.WithValue(ctx, callMetadataKey{}, &callMetadata{incoming: req.Metadata})
+	}
+	if c.calls == nil {
+		c.calls = make(map[uint32]context.CancelFunc)
+	}
+	c.calls[req.Seq] = cancel
+	c.inFlight++
+	c.wg.Add(1)
+	return ctx, true
+}
+
+// endCall is called once the handler of a dispatched request has returned
+// and its response has been sent.
+func (c *Conn) endCall(req *Request) {
+	c.mu.Lock()
+	cancel := c.calls[req.Seq]
+	delete(c.calls, req.Seq)
+	delete(c.streams, req.Seq)
+	delete(c.duplexes, req.Seq)
+	c.inFlight--
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	c.wg.Done()
+}
+
+// control handles a frame other than a call and reads its body.
+func (c *Conn) control(req *Request) error {
+	c.mu.Lock()
+	cancel := c.calls[req.Seq]
+	stream := c.streams[req.Seq]
+	duplex := c.duplexes[req.Seq]
+	c.mu.Unlock()
+
+	if duplex != nil {
+		switch req.Kind {
+		case KindStreamData, KindStreamEnd, KindStreamReset:
+			return duplex.receive(req.Kind, req.Error, c.codec.ReadRequestBody)
+		}
+	}
+	// Other frames carry no meaningful body.
+	if err := c.codec.ReadRequestBody(nil); err != nil {
+		return err
+	}
+	switch req.Kind {
+	case KindCancel:
+		if cancel != nil {
+			cancel()
+		}
+	case KindWindow:
+		switch {
+		case stream != nil:
+			stream.out.grant(req.Window)
+		case duplex != nil:
+			duplex.out.grant(req.Window)
+		}
+	case KindStreamData, KindStreamEnd, KindStreamReset:
+		// The stream is over; drop the frame.
+	case KindPing:
+		// Writing from the reading goroutine could deadlock with a client
+		// answering a ping of ours.
+		go c.writeFrame(&Response{Cmd: req.Cmd, Seq: req.Seq, Kind: KindPong}, invalidRequest)
+	case KindPong:
+		// Reading it was all the watchdog needed.
+	case KindHello:
+		v := req.Version
+		if v > ProtocolVersion {
+			v = ProtocolVersion
+		}
+		c.mu.Lock()
+		c.version = v
+		c.mu.Unlock()
+		// Answered before any other request is read, so that the
+		// client gets it before any reply.
+		return c.writeFrame(&Response{Kind: KindHello, Version: v}, invalidRequest)
+	default:
+		if debugLog {
+			log.Println("rpc: unknown frame kind", req.Kind)
+		}
+	}
+	return nil
+}
+
+// ping asks the client for a pong.
+func (c *Conn) ping() {
+	resp := c.server.getResponse()
+	resp.Kind = KindPing
+	c.writeFrame(resp, invalidRequest)
+	c.server.freeResponse(resp)
+}
+
+// idle reports whether the connection has no call in flight.
+func (c *Conn) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inFlight == 0
+}
+
+// closeIfIdle closes the connection if it has no call in flight.
+func (c *Conn) closeIfIdle() {
+	if c.idle() {
+		c.Close()
+	}
+}
+
+// finish waits for in-flight calls, then closes the connection and runs the close hooks.
+func (c *Conn) finish() {
+	c.wg.Wait()
+	c.Close()
+	c.cancel()
+	c.mu.Lock()
+	c.closed = true
+	hooks := c.closeHooks
+	c.closeHooks = nil
+	c.mu.Unlock()
+	for _, f := range hooks {
+		f(c)
+	}
+}
+
+func (server *Server) newConn(ctx context.Context, codec ServerCodec) *Conn {
+	c := &Conn{
+		server: server,
+		codec:  codec,
+		id:     atomic.AddUint64(&connID, 1),
+		start:  time.Now(),
+	}
+	if ra, ok := codec.(interface{ RemoteAddr() net.Addr }); ok {
+		c.remote = ra.RemoteAddr()
+	}
+	c.tls, _ = ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	c.ctx, c.cancel = context.WithCancel(context.WithValue(ctx, connKey{}, c))
+	server.connLock.Lock()
+	server.conns[c] = struct{}{}
+	server.connLock.Unlock()
+	return c
+}
+
+func (server *Server) removeConn(c *Conn) {
+	server.connLock.Lock()
+	delete(server.conns, c)
+	server.connLock.Unlock()
+}
@@ -0,0 +1,111 @@
+package rpc
+
+/*
+	Some HTML presented at http://machine:port/debug/rpc
+	Lists the registered cmds, their call statistics and the live
+	connections.
+*/
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const debugText = `<html>
+	<body>
+	<title>Services</title>
+	<h2>Cmds</h2>
+	<table border=1 cellpadding=5>
+	<th align=center>Cmd</th><th align=center>Handler</th><th align=center>Args</th><th align=center>Reply</th><th align=center>Calls</th><th align=center>In flight</th><th align=center>Errors</th>
+	{{range .Methods}}
+		<tr>
+		<td align=left>{{.Cmd}}</td>
+		<td align=left>{{.Name}}</td>
+		<td align=left>{{.Type.ArgType}}</td>
+		<td align=left>{{.Type.ReplyType}}</td>
+		<td align=right>{{.Type.NumCalls}}</td>
+		<td align=right>{{.Type.InFlight}}</td>
+		<td align=left>{{range .Errors}}{{.Code}}: {{.Count}}<br>{{end}}</td>
+		</tr>
+	{{end}}
+	</table>
+	<h2>Connections</h2>
+	<table border=1 cellpadding=5>
+	<th align=center>ID</th><th align=center>Remote address</th><th align=center>Connected</th>
+	{{range .Conns}}
+		<tr>
+		<td align=right>{{.ID}}</td>
+		<td align=left>{{.RemoteAddr}}</td>
+		<td align=left>{{.Start.Format "2006-01-02 15:04:05"}} ({{.Age}})</td>
+		</tr>
+	{{end}}
+	</table>
+	</body>
+	</html>`
+
+var debug = template.Must(template.New("RPC debug").Parse(debugText))
+
+type debugError struct {
+	Code  Error
+	Count uint64
+}
+
+type debugMethod struct {
+	Type   *methodType
+	Cmd    uint32
+	Name   string
+	Errors []debugError
+}
+
+type debugConn struct {
+	*Conn
+	Age time.Duration
+}
+
+type debugPage struct {
+	Methods []debugMethod
+	Conns   []debugConn
+}
+
+type debugHTTP struct {
+	*Server
+}
+
+// Runs at /debug/rpc
+func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var page debugPage
+	now := time.Now()
+
+	server.mu.RLock()
+	for cmd, mtype := range server.method {
+		m := debugMethod{Type: mtype, Cmd: cmd, Name: mtype.Func.Type().String()}
+		if f := runtime.FuncForPC(mtype.Func.Pointer()); f != nil {
+			m.Name = f.Name()
+		}
+		mtype.errLock.Lock()
+		for code, n := range mtype.errCount {
+			m.Errors = append(m.Errors, debugError{Error(code), n})
+		}
+		mtype.errLock.Unlock()
+		sort.Slice(m.Errors, func(i, j int) bool { return m.Errors[i].Code < m.Errors[j].Code })
+		page.Methods = append(page.Methods, m)
+	}
+	server.mu.RUnlock()
+	sort.Slice(page.Methods, func(i, j int) bool { return page.Methods[i].Cmd < page.Methods[j].Cmd })
+
+	server.connLock.Lock()
+	for conn := range server.conns {
+		page.Conns = append(page.Conns, debugConn{conn, now.Sub(conn.start).Truncate(time.Second)})
+	}
+	server.connLock.Unlock()
+	sort.Slice(page.Conns, func(i, j int) bool { return page.Conns[i].id < page.Conns[j].id })
+
+	err := debug.Execute(w, page)
+	if err != nil {
+		fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+	}
+}
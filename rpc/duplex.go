@@ -0,0 +1,308 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// ErrSendClosed is returned by Duplex.Send after CloseSend.
+var ErrSendClosed = errors.New("rpc: send on closed stream")
+
+var typeOfDuplex = reflect.TypeOf((*Duplex)(nil))
+
+// Duplex is a stream on which both the client and the server send
+// elements, multiplexed with the calls and other streams of the
+// connection.  Each side ends its own elements with CloseSend; the
+// stream is over when the server's handler returns or either side calls
+// Reset.  Sends are flow controlled like those of a ServerStream.
+//
+// Send and CloseSend must be called from one goroutine at a time, and so
+// must Recv, but the two may run concurrently.
+type Duplex struct {
+	Cmd uint32 // the cmd the stream was opened on
+	Seq uint32 // identifies the stream on the connection
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	out    *credit
+	in     *inbox
+	// write sends a frame of the stream to the peer.
+	write func(kind uint8, code, window uint32, body interface{}) error
+
+	// Set on the client side.
+	client *Client
+	stop   func() bool
+
+	mu      sync.Mutex // protects following
+	sendErr error      // returned by Send once set
+	recvEnd bool       // in has been ended
+	done    bool       // the stream is over
+	err     error      // the error the stream ended with
+}
+
+// openDuplex registers the duplex stream opened by req and grants the
+// client its window.
+func (c *Conn) openDuplex(ctx context.Context, req *Request, elem reflect.Type) *Duplex {
+	server := c.server
+	cmd, seq := req.Cmd, req.Seq
+	d := &Duplex{
+		Cmd: cmd,
+		Seq: seq,
+		ctx: ctx,
+		out: newCredit(req.Window, req.Window == 0),
+		in:  newInbox(elem, DefaultStreamWindow),
+		write: func(kind uint8, code, window uint32, body interface{}) error {
+			resp := server.getResponse()
+			resp.Cmd = cmd
+			resp.Seq = seq
+			resp.Kind = kind
+			resp.Error = code
+			resp.Window = window
+			err := c.writeFrame(resp, body)
+			server.freeResponse(resp)
+			return err
+		},
+	}
+	c.mu.Lock()
+	d.cancel = c.calls[seq]
+	if c.duplexes == nil {
+		c.duplexes = make(map[uint32]*Duplex)
+	}
+	c.duplexes[seq] = d
+	c.mu.Unlock()
+	d.write(KindWindow, 0, DefaultStreamWindow, invalidRequest)
+	return d
+}
+
+// OpenDuplex opens a duplex stream on cmd with args and returns it once
+// the request is sent.  elem gives the type of the elements sent by the
+// server, as for OnNotify.  The stream is reset when ctx is done.
+func (client *Client) OpenDuplex(ctx context.Context, cmd uint32, args interface{}, elem interface{}) (*Duplex, error) {
+	d := &Duplex{
+		Cmd:    cmd,
+		client: client,
+		// The server grants credit once it has set the stream up.
+		out: newCredit(0, false),
+		in:  newInbox(elemType(elem), DefaultStreamWindow),
+	}
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	d.write = func(kind uint8, code, window uint32, body interface{}) error {
+		return client.writeFrame(Request{Cmd: cmd, Seq: d.Seq, Kind: kind, Error: code, Window: window}, body)
+	}
+	req := Request{Cmd: cmd, Kind: KindDuplex, Window: DefaultStreamWindow}
+	err := client.openStream(d.ctx, &req, args, d, func() {
+		d.Seq = req.Seq
+		d.stop = context.AfterFunc(d.ctx, func() {
+			if d.terminate(context.Cause(d.ctx), true) {
+				d.write(KindCancel, 0, 0, invalidRequest)
+			}
+		})
+	})
+	if err != nil {
+		if d.stop != nil {
+			d.stop()
+		}
+		d.cancel()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Context returns the context of the stream, which is done once the
+// stream is over.
+func (d *Duplex) Context() context.Context {
+	return d.ctx
+}
+
+// Err returns the error the stream ended with once it is over, and nil
+// while it runs or if it ended cleanly.  On the client it tells the
+// outcome of the server's handler even after Recv has returned io.EOF.
+func (d *Duplex) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// Send writes v as the next element of the stream, waiting for the peer
+// to make room for it.  It fails with ErrSendClosed after CloseSend, and
+// with the error the stream ended with once it is over.
+func (d *Duplex) Send(v interface{}) error {
+	d.mu.Lock()
+	err := d.sendErr
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = d.out.wait(d.ctx)
+	if err == nil && d.ctx.Err() != nil {
+		err = context.Cause(d.ctx)
+	}
+	if err != nil {
+		d.mu.Lock()
+		if d.sendErr != nil {
+			err = d.sendErr
+		}
+		d.mu.Unlock()
+		return err
+	}
+	return d.write(KindStreamData, 0, 0, v)
+}
+
+// CloseSend tells the peer that no more elements will be sent.  The
+// elements sent by the peer can still be received.
+func (d *Duplex) CloseSend() error {
+	d.mu.Lock()
+	closed := d.sendErr != nil
+	if !closed {
+		d.sendErr = ErrSendClosed
+	}
+	d.mu.Unlock()
+	if closed {
+		return nil
+	}
+	return d.write(KindStreamEnd, 0, 0, invalidRequest)
+}
+
+// Recv returns the next element sent by the peer, a pointer to a freshly
+// decoded value of the element type.  It returns io.EOF once the peer has
+// called CloseSend or the stream has ended without error, and the error
+// the stream ended with otherwise.
+func (d *Duplex) Recv() (interface{}, error) {
+	v, grant, err := d.in.next(d.ctx)
+	if grant > 0 {
+		d.mu.Lock()
+		done := d.done
+		d.mu.Unlock()
+		if !done {
+			d.write(KindWindow, 0, grant, invalidRequest)
+		}
+	}
+	return v, err
+}
+
+// Reset aborts the stream in both directions.  The peer sees code as the
+// error of the stream, and so do later calls to Send and Recv.
+func (d *Duplex) Reset(code Error) error {
+	if !d.terminate(code, true) {
+		return nil
+	}
+	return d.write(KindStreamReset, uint32(code), 0, invalidRequest)
+}
+
+// terminate ends the stream with err, dropping the elements not received
+// yet if drop is set.  It reports false if the stream was already over.
+func (d *Duplex) terminate(err error, drop bool) bool {
+	d.mu.Lock()
+	if d.done {
+		d.mu.Unlock()
+		return false
+	}
+	d.done = true
+	if err != io.EOF {
+		d.err = err
+	}
+	if d.sendErr == nil {
+		d.sendErr = err
+	}
+	recvEnd := d.recvEnd
+	d.recvEnd = true
+	d.mu.Unlock()
+
+	if d.client != nil {
+		d.client.dropStream(d.Seq, d)
+		d.stop()
+	}
+	if !recvEnd {
+		d.in.end(err, drop)
+	}
+	if d.cancel != nil {
+		d.cancel()
+	}
+	return true
+}
+
+// handlerDone is called when the server's handler has returned.  It
+// reports whether the client must still be told that the stream is over.
+func (d *Duplex) handlerDone() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.done {
+		return false
+	}
+	d.done = true
+	return true
+}
+
+// receive handles a data, end or reset frame sent by the peer, reading
+// its body with read.
+func (d *Duplex) receive(kind uint8, code uint32, read func(interface{}) error) error {
+	if kind == KindStreamData {
+		body := reflect.New(d.in.typ).Interface()
+		if err := read(body); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		open := !d.recvEnd
+		d.mu.Unlock()
+		if open && !d.in.put(body) {
+			if d.terminate(errWindowExceeded, true) {
+				d.write(KindStreamReset, errorCode(errWindowExceeded), 0, invalidRequest)
+			}
+		}
+		return nil
+	}
+	if err := read(nil); err != nil {
+		return err
+	}
+	var end error = io.EOF
+	if code != 0 {
+		end = Error(code)
+	}
+	if kind == KindStreamReset {
+		d.terminate(end, false)
+		return nil
+	}
+	d.mu.Lock()
+	recvEnd := d.recvEnd
+	d.recvEnd = true
+	d.mu.Unlock()
+	if !recvEnd {
+		d.in.end(end, false)
+	}
+	return nil
+}
+
+func (d *Duplex) frame(response *Response) error {
+	read := d.client.codec.ReadResponseBody
+	if response.Kind == KindStreamReset && response.ErrorBody {
+		end, err := d.client.readError(response)
+		d.terminate(end, false)
+		return err
+	}
+	switch response.Kind {
+	case KindStreamData, KindStreamEnd, KindStreamReset:
+		return d.receive(response.Kind, response.Error, read)
+	case KindWindow:
+		if err := read(nil); err != nil {
+			return err
+		}
+		d.out.grant(response.Window)
+		return nil
+	}
+	// A plain reply, from a server that predates streams.
+	if response.Error != 0 {
+		end, err := d.client.readError(response)
+		d.terminate(end, false)
+		return err
+	}
+	err := read(nil)
+	d.terminate(ErrNoStreams, false)
+	return err
+}
+
+func (d *Duplex) fail(err error) {
+	d.terminate(err, false)
+}
@@ -0,0 +1,195 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDuplex(t *testing.T) {
+	server := NewServer()
+	// Echoes the doubled elements until the client is done sending.
+	double := func(ctx context.Context, arg int, stream *Duplex) error {
+		for {
+			v, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(*v.(*int) * arg); err != nil {
+				return err
+			}
+		}
+	}
+	// Closes its side at once, then sums what the client sends.
+	sum := func(ctx context.Context, arg int, stream *Duplex) error {
+		stream.CloseSend()
+		total := 0
+		for {
+			v, err := stream.Recv()
+			if err == io.EOF {
+				return Error(total)
+			}
+			if err != nil {
+				return err
+			}
+			total += *v.(*int)
+		}
+	}
+	reset := make(chan error, 1)
+	resets := func(ctx context.Context, arg int, stream *Duplex) error {
+		if arg != 0 {
+			return stream.Reset(Error(arg))
+		}
+		_, err := stream.Recv()
+		reset <- err
+		return nil
+	}
+	for cmd, f := range map[uint32]interface{}{1: double, 2: sum, 3: resets} {
+		if err := server.RegisterDuplex(cmd, f, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+
+	// Both sides send at once, well past the window.
+	d, err := c.OpenDuplex(context.Background(), 1, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 100
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := d.Send(i); err != nil {
+				t.Error("Send", i, err)
+				return
+			}
+		}
+		d.CloseSend()
+	}()
+	for i := 0; i < n; i++ {
+		v, err := d.Recv()
+		if err != nil {
+			t.Fatal("Recv", i, err)
+		}
+		if *v.(*int) != 2*i {
+			t.Fatal("element", i, "is", *v.(*int))
+		}
+	}
+	if _, err := d.Recv(); err != io.EOF {
+		t.Fatal("end of stream returned", err)
+	}
+	<-d.Context().Done()
+	if err := d.Err(); err != nil {
+		t.Fatal("clean stream ended with", err)
+	}
+
+	// The client keeps sending after the server has closed its side.
+	d, err = c.OpenDuplex(context.Background(), 2, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Recv(); err != io.EOF {
+		t.Fatal("Recv after server CloseSend returned", err)
+	}
+	for i := 1; i <= 4; i++ {
+		if err := d.Send(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.CloseSend()
+	if err := d.Send(5); err != ErrSendClosed {
+		t.Fatal("Send after CloseSend returned", err)
+	}
+	<-d.Context().Done()
+	if err := d.Err(); err != Error(10) {
+		t.Fatal("stream ended with", err)
+	}
+
+	// The server resets the stream.
+	d, err = c.OpenDuplex(context.Background(), 3, 9, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Recv(); err != Error(9) {
+		t.Fatal("Recv on a reset stream returned", err)
+	}
+	if err := d.Send(1); err != Error(9) {
+		t.Fatal("Send on a reset stream returned", err)
+	}
+
+	// The client resets the stream.
+	d, err = c.OpenDuplex(context.Background(), 3, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Reset(7)
+	select {
+	case err := <-reset:
+		if err != Error(7) {
+			t.Fatal("handler saw", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reset did not reach the handler")
+	}
+	if _, err := d.Recv(); err != Error(7) {
+		t.Fatal("Recv after Reset returned", err)
+	}
+}
+
+func TestDuplexFlowControl(t *testing.T) {
+	server := NewServer()
+	release := make(chan struct{})
+	drain := func(ctx context.Context, arg int, stream *Duplex) error {
+		<-release
+		for {
+			if _, err := stream.Recv(); err != nil {
+				return nil
+			}
+		}
+	}
+	if err := server.RegisterDuplex(1, drain, 0); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+
+	d, err := c.OpenDuplex(context.Background(), 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent int32
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 3*DefaultStreamWindow; i++ {
+			if err := d.Send(i); err != nil {
+				done <- err
+				return
+			}
+			atomic.AddInt32(&sent, 1)
+		}
+		done <- d.CloseSend()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n != DefaultStreamWindow {
+		t.Fatal("client sent", n, "elements to a server not reading")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	<-d.Context().Done()
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
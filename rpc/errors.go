@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Error is the code a call failed with, sent on the wire in Response.Error.
+// It prints as the name registered with RegisterErrorName, or as a number.
+type Error uint32
+
+// ErrInternal is the code of the errors returned by handlers that carry no
+// code of their own.
+const ErrInternal Error = 0xFFFFFFFF
+
+var errorNames = struct {
+	sync.RWMutex
+	m map[Error]string
+}{m: map[Error]string{ErrInternal: "internal error"}}
+
+// RegisterErrorName sets the name code prints as.  It is meant to be
+// called from init functions, once per code.
+func RegisterErrorName(code Error, name string) {
+	errorNames.Lock()
+	errorNames.m[code] = name
+	errorNames.Unlock()
+}
+
+func (e Error) Error() string {
+	errorNames.RLock()
+	name, ok := errorNames.m[e]
+	errorNames.RUnlock()
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("%d", uint32(e))
+}
+
+// StatusError is an error carrying a message and details along with its
+// code.  A handler returns one to tell the client more than the code; the
+// client gets one back for every error the server sent a message for,
+// including the errors without a code, which have code ErrInternal.
+// errors.Is(err, code) and errors.As(err, &code) see the code.
+//
+// Peers that predate StatusError only see the code.
+type StatusError struct {
+	Code    Error
+	Message string
+	Details map[string]string // optional, for programs to act on
+}
+
+// Errorf returns a StatusError with code and the formatted message.
+func Errorf(code Error, format string, a ...interface{}) *StatusError {
+	return &StatusError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *StatusError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Code.Error())
+	if e.Message != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Message)
+	}
+	if len(e.Details) > 0 {
+		keys := make([]string, 0, len(e.Details))
+		for k := range e.Details {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString(" (")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "%s=%s", k, e.Details[k])
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// Unwrap returns the code of the error.
+func (e *StatusError) Unwrap() error {
+	return e.Code
+}
+
+// errorCode returns the code sent on the wire for a non-nil handler error.
+func errorCode(err error) uint32 {
+	var code Error
+	if errors.As(err, &code) {
+		return uint32(code)
+	}
+	return uint32(ErrInternal)
+}
+
+// errorStatus returns the StatusError sent in the body of the response to
+// a call failing with err, or nil if the code says it all.
+func errorStatus(err error) *StatusError {
+	if _, ok := err.(Error); ok {
+		return nil
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status
+	}
+	return &StatusError{Code: Error(errorCode(err)), Message: err.Error()}
+}
+
+// readError reads the body of the error response r and returns the error
+// of the call, along with the error reading the body.
+func (client *Client) readError(r *Response) (callErr error, err error) {
+	if !r.ErrorBody {
+		return Error(r.Error), client.codec.ReadResponseBody(nil)
+	}
+	status := new(StatusError)
+	err = client.codec.ReadResponseBody(status)
+	status.Code = Error(r.Error)
+	return status, err
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+const errNotFound Error = 404
+
+func init() {
+	RegisterErrorName(errNotFound, "not found")
+}
+
+// lookup fails in a different way for every value of arg.A.
+func lookup(ctx context.Context, arg *Pair, reply *Pair) error {
+	switch arg.A {
+	case 1:
+		return errNotFound
+	case 2:
+		return &StatusError{Code: errNotFound, Message: "no user 42", Details: map[string]string{"user": "42"}}
+	case 3:
+		return fmt.Errorf("loading user: %w", errNotFound)
+	case 4:
+		return errors.New("database is down")
+	}
+	*reply = *arg
+	return nil
+}
+
+func TestStatusError(t *testing.T) {
+	if s := errNotFound.Error(); s != "not found" {
+		t.Fatal("registered code prints as", s)
+	}
+	if s := Error(405).Error(); s != "405" {
+		t.Fatal("unregistered code prints as", s)
+	}
+
+	gob := NewServer()
+	if err := gob.Register(1, lookup); err != nil {
+		t.Fatal(err)
+	}
+	proto := NewProtoServer()
+	if err := proto.Register(1, lookup); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go gob.ServeConn(context.Background(), srv)
+	gobClient := NewClient(cli)
+	defer gobClient.Close()
+	cli, srv = net.Pipe()
+	go proto.ServeProtoConn(context.Background(), srv)
+	protoClient := NewProtoClient(cli)
+	defer protoClient.Close()
+
+	for _, c := range []*Client{gobClient, protoClient} {
+		var reply Pair
+		// A bare code stays a bare code.
+		if err := c.Call(1, &Pair{A: 1}, &reply); err != errNotFound {
+			t.Fatal("bare code returned", err)
+		}
+
+		err := c.Call(1, &Pair{A: 2}, &reply)
+		want := &StatusError{Code: errNotFound, Message: "no user 42", Details: map[string]string{"user": "42"}}
+		var status *StatusError
+		if !errors.As(err, &status) || !reflect.DeepEqual(status, want) {
+			t.Fatalf("status error returned %#v", err)
+		}
+		if !errors.Is(err, errNotFound) {
+			t.Fatal("errors.Is does not see the code of", err)
+		}
+		if s := err.Error(); s != "not found: no user 42 (user=42)" {
+			t.Fatal("status error prints as", s)
+		}
+
+		err = c.Call(1, &Pair{A: 3}, &reply)
+		if !errors.Is(err, errNotFound) || err.Error() != "not found: loading user: not found" {
+			t.Fatal("wrapped code returned", err)
+		}
+
+		err = c.Call(1, &Pair{A: 4}, &reply)
+		var code Error
+		if !errors.As(err, &code) || code != ErrInternal || err.Error() != "internal error: database is down" {
+			t.Fatal("error without a code returned", err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// maxJSONBody bounds the size of a request accepted by the JSON gateway.
+const maxJSONBody = 10 << 20
+
+// JSONHandler returns an http.Handler exposing the server's cmds to plain
+// HTTP clients.  It accepts POST bodies holding a JsonRequest, or an array
+// of them, dispatches each to the function registered for its Cmd and
+// writes back a JsonResponse, or an array of them in the same order.
+//
+// Handlers see a Conn standing for the HTTP request; it has no peer to
+// push notifications to, and is closed once the response is written.
+func (server *Server) JSONHandler() http.Handler {
+	return jsonHTTP{server}
+}
+
+type jsonHTTP struct {
+	*Server
+}
+
+func (server jsonHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 must POST", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	if err != nil {
+		http.Error(w, "rpc: reading request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn := server.newHTTPConn(r)
+	defer conn.finish()
+
+	var resp interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var reqs []JsonRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			http.Error(w, "rpc: decoding request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		resps := make([]*JsonResponse, len(reqs))
+		for i := range reqs {
+			resps[i] = server.jsonCall(conn, &reqs[i])
+		}
+		resp = resps
+	} else {
+		var req JsonRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "rpc: decoding request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp = server.jsonCall(conn, &req)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// jsonCall dispatches a single request of the JSON gateway.
+func (server jsonHTTP) jsonCall(conn *Conn, req *JsonRequest) *JsonResponse {
+	resp := &JsonResponse{Cmd: req.Cmd, Seq: req.Seq}
+	server.mu.RLock()
+	mtype := server.method[req.Cmd]
+	server.mu.RUnlock()
+	if mtype == nil {
+		resp.Error = "rpc: can't find method"
+		return resp
+	}
+	if mtype.kind != KindCall {
+		resp.Error = "rpc: method is a stream"
+		return resp
+	}
+
+	argIsValue := false
+	var argv reflect.Value
+	if mtype.ArgType.Kind() == reflect.Ptr {
+		argv = reflect.New(mtype.ArgType.Elem())
+	} else {
+		argv = reflect.New(mtype.ArgType)
+		argIsValue = true
+	}
+	if req.Params != nil {
+		if err := json.Unmarshal(*req.Params, argv.Interface()); err != nil {
+			resp.Error = "rpc: decoding params: " + err.Error()
+			return resp
+		}
+	}
+	if argIsValue {
+		argv = argv.Elem()
+	}
+	replyv := reflect.New(mtype.ReplyType.Elem())
+
+	reply, err := server.invoke(conn.ctx, conn, mtype, req.Cmd, argv.Interface(), replyv.Interface())
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.Result = reply
+	return resp
+}
+
+// httpAddr is the address of an HTTP client, as found in
+// http.Request.RemoteAddr.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+var errNoPeer = errors.New("rpc: connection has no peer to notify")
+
+// noPeerCodec stands in for the codec of the Conn of an HTTP request.
+type noPeerCodec struct{}
+
+func (noPeerCodec) ReadRequestHeader(*Request) error           { return io.EOF }
+func (noPeerCodec) ReadRequestBody(interface{}) error          { return io.EOF }
+func (noPeerCodec) WriteResponse(*Response, interface{}) error { return errNoPeer }
+func (noPeerCodec) Close() error                               { return nil }
+
+// newHTTPConn returns the Conn standing for an HTTP request of the JSON
+// gateway.  It is not listed among the server's connections.
+func (server *Server) newHTTPConn(r *http.Request) *Conn {
+	c := &Conn{
+		server: server,
+		codec:  noPeerCodec{},
+		id:     atomic.AddUint64(&connID, 1),
+		remote: httpAddr(r.RemoteAddr),
+		start:  time.Now(),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.WithValue(r.Context(), connKey{}, c))
+	return c
+}
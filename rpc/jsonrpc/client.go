@@ -11,8 +11,8 @@ import (
 	"fmt"
 	rpc "github.com/lijie/go/rpc"
 	"io"
+	"math"
 	"net"
-	"sync"
 )
 
 type clientCodec struct {
@@ -23,22 +23,14 @@ type clientCodec struct {
 	// temporary work space
 	req  clientRequest
 	resp clientResponse
-
-	// JSON-RPC responses include the request id but not the request method.
-	// Package rpc expects both.
-	// We save the request method in pending when sending a request
-	// and then look it up by request ID when filling out the rpc Response.
-	mutex   sync.Mutex        // protects pending
-	pending map[uint64]string // map request id to method name
 }
 
 // NewClientCodec returns a new rpc.ClientCodec using JSON-RPC on conn.
 func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
 	return &clientCodec{
-		dec:     json.NewDecoder(conn),
-		enc:     json.NewEncoder(conn),
-		c:       conn,
-		pending: make(map[uint64]string),
+		dec: json.NewDecoder(conn),
+		enc: json.NewEncoder(conn),
+		c:   conn,
 	}
 }
 
@@ -49,6 +41,16 @@ type clientRequest struct {
 }
 
 func (c *clientCodec) WriteRequest(r *rpc.Request, param interface{}) error {
+	if r.Kind == rpc.KindStream || r.Kind == rpc.KindDuplex {
+		return rpc.ErrNoStreams
+	}
+	if r.Kind == rpc.KindHello {
+		return rpc.ErrNoMetadata
+	}
+	if r.Kind != rpc.KindCall {
+		// JSON-RPC has no control frames.
+		return nil
+	}
 	c.req.Cmd = r.Cmd
 	c.req.Params[0] = param
 	c.req.Id = r.Seq
@@ -75,18 +77,19 @@ func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
 
 	r.Error = 0
 	r.Seq = c.resp.Id
-	if c.resp.Error != nil || c.resp.Result == nil {
-		x, ok := c.resp.Error.(uint32)
-		if !ok {
+	if c.resp.Error != nil {
+		// JSON numbers decode as float64.
+		x, ok := c.resp.Error.(float64)
+		if !ok || x < 1 || x > math.MaxUint32 || x != math.Trunc(x) {
 			return fmt.Errorf("invalid error %v", c.resp.Error)
 		}
-		r.Error = x
+		r.Error = uint32(x)
 	}
 	return nil
 }
 
 func (c *clientCodec) ReadResponseBody(x interface{}) error {
-	if x == nil {
+	if x == nil || c.resp.Result == nil {
 		return nil
 	}
 	return json.Unmarshal(*c.resp.Result, x)
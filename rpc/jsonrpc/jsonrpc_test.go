@@ -0,0 +1,205 @@
+package jsonrpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	rpc "github.com/lijie/go/rpc"
+)
+
+type Args struct {
+	A, B int
+}
+
+func add(ctx context.Context, arg *Args, reply *int) error {
+	if arg.A < 0 {
+		return rpc.Error(42)
+	}
+	*reply = arg.A + arg.B
+	return nil
+}
+
+func newServer(t *testing.T) *rpc.Server {
+	server := rpc.NewServer()
+	if err := server.Register(1, add); err != nil {
+		t.Fatal(err)
+	}
+	notify := func(ctx context.Context, arg string, reply *int) error {
+		return rpc.ConnFromContext(ctx).Notify(2, arg)
+	}
+	if err := server.Register(2, notify); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestClientServer(t *testing.T) {
+	cli, srv := net.Pipe()
+	go newServer(t).ServeCodec(context.Background(), NewServerCodec(srv))
+	c := NewClient(cli)
+	defer c.Close()
+
+	reply := 0
+	if err := c.Call(1, &Args{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call:", reply, err)
+	}
+	if err := c.Call(1, &Args{-1, 2}, &reply); err != rpc.Error(42) {
+		t.Fatal("failing call returned", err)
+	}
+}
+
+func newRegistry() *Registry {
+	reg := NewRegistry()
+	reg.Register("add", 1)
+	reg.Register("echo", 2)
+	return reg
+}
+
+func TestClientServerV2(t *testing.T) {
+	reg := newRegistry()
+	cli, srv := net.Pipe()
+	go newServer(t).ServeCodec(context.Background(), NewServerCodecV2(srv, reg))
+	c := NewClientV2(cli, reg)
+	defer c.Close()
+
+	reply := 0
+	if err := c.Call(1, &Args{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call:", reply, err)
+	}
+	if err := c.Call(1, &Args{-1, 2}, &reply); err != rpc.Error(42) {
+		t.Fatal("failing call returned", err)
+	}
+
+	got := make(chan string, 1)
+	c.OnNotify(2, "", func(cmd uint32, body interface{}) {
+		got <- *body.(*string)
+	})
+	if err := c.Call(2, "hello", &reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-got:
+		if s != "hello" {
+			t.Fatal("notification:", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notification not delivered")
+	}
+}
+
+// TestClientV2Errors checks that the errors of the specification reach
+// the caller with their code, message and data.
+func TestClientV2Errors(t *testing.T) {
+	reg := newRegistry()
+	reg.Register("nope", 3)
+	cli, srv := net.Pipe()
+	go newServer(t).ServeCodec(context.Background(), NewServerCodecV2(srv, newRegistry()))
+	c := NewClientV2(cli, reg)
+	defer c.Close()
+
+	reply := 0
+	err := c.Call(3, &Args{}, &reply)
+	status, ok := err.(*rpc.StatusError)
+	if !ok || status.Code != ErrMethodNotFound || status.Message != "method not found" {
+		t.Fatalf("call to unknown method returned %#v", err)
+	}
+	if code := int32(status.Code); code != CodeMethodNotFound {
+		t.Errorf("code %d, want %d", code, CodeMethodNotFound)
+	}
+
+	// A peer sending data with the error.
+	cli, srv = net.Pipe()
+	go func() {
+		dec := json.NewDecoder(srv)
+		for {
+			var req struct{ Id json.RawMessage }
+			if dec.Decode(&req) != nil {
+				return
+			}
+			fmt.Fprintf(srv, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"bad A","data":{"field":"A"}},"id":%s}`+"\n", req.Id)
+		}
+	}()
+	c2 := NewClientV2(cli, reg)
+	defer c2.Close()
+	err = c2.Call(1, &Args{}, &reply)
+	if !errors.Is(err, ErrInvalidParams) || !errors.As(err, &status) || status.Message != "bad A" || status.Details["field"] != "A" {
+		t.Fatalf("call returned %#v", err)
+	}
+}
+
+// TestServerV2Wire plays an off-the-shelf JSON-RPC 2.0 client.
+func TestServerV2Wire(t *testing.T) {
+	cli, srv := net.Pipe()
+	go newServer(t).ServeCodec(context.Background(), NewServerCodecV2(srv, newRegistry()))
+	defer cli.Close()
+	r := bufio.NewReader(cli)
+
+	roundTrip := func(req string) interface{} {
+		t.Helper()
+		if _, err := cli.Write([]byte(req + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp interface{}
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	check := func(got interface{}, want string) {
+		t.Helper()
+		var w interface{}
+		json.Unmarshal([]byte(want), &w)
+		gb, _ := json.Marshal(got)
+		wb, _ := json.Marshal(w)
+		if string(gb) != string(wb) {
+			t.Fatalf("got %s\nwant %s", gb, wb)
+		}
+	}
+
+	check(roundTrip(`{"jsonrpc":"2.0","method":"add","params":{"A":1,"B":2},"id":"x"}`),
+		`{"jsonrpc":"2.0","result":3,"id":"x"}`)
+	check(roundTrip(`{"jsonrpc":"2.0","method":"add","params":[{"A":-1}],"id":1}`),
+		`{"jsonrpc":"2.0","error":{"code":42,"message":"42"},"id":1}`)
+	check(roundTrip(`{"jsonrpc":"2.0","method":"nope","id":2}`),
+		`{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found"},"id":2}`)
+	check(roundTrip(`{"jsonrpc":"2.0","method":"add","params":"bad","id":3}`),
+		`{"jsonrpc":"2.0","error":{"code":-32602,"message":"invalid params"},"id":3}`)
+	check(roundTrip(`[]`),
+		`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":null}`)
+
+	// A notification gets no response, so the next line answers the batch,
+	// whose own notification is not answered either.
+	batch := roundTrip(`{"jsonrpc":"2.0","method":"add","params":[{"A":5}]}` + "\n" +
+		`[{"jsonrpc":"2.0","method":"add","params":[{"A":1,"B":1}],"id":1},` +
+		`{"jsonrpc":"2.0","method":"add","params":[{"A":2,"B":2}]},` +
+		`{"foo":"bar"},` +
+		`{"jsonrpc":"2.0","method":"add","params":[{"A":3,"B":3}],"id":2}]`)
+	resps, ok := batch.([]interface{})
+	if !ok || len(resps) != 3 {
+		t.Fatalf("batch response: %v", batch)
+	}
+	results := make(map[string]bool)
+	for _, resp := range resps {
+		b, _ := json.Marshal(resp)
+		results[string(b)] = true
+	}
+	for _, want := range []string{
+		`{"id":1,"jsonrpc":"2.0","result":2}`,
+		`{"id":2,"jsonrpc":"2.0","result":6}`,
+		`{"error":{"code":-32600,"message":"invalid request"},"id":null,"jsonrpc":"2.0"}`,
+	} {
+		if !results[want] {
+			t.Errorf("batch response missing %s in %v", want, results)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	rpc "github.com/lijie/go/rpc"
 	"io"
+	"net"
 )
 
 var errMissingParams = errors.New("jsonrpc: request body missing params")
@@ -62,6 +63,7 @@ func (c *ServerCodec) ReadRequestHeader(r *rpc.Request) error {
 		return err
 	}
 	r.Cmd = c.req.Cmd
+	r.Seq = c.req.Id
 	return nil
 }
 
@@ -84,6 +86,10 @@ func (c *ServerCodec) ReadRequestBody(x interface{}) error {
 var null = json.RawMessage([]byte("null"))
 
 func (c *ServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	if r.Kind != rpc.KindCall {
+		// JSON-RPC has no control frames.
+		return nil
+	}
 	resp := serverResponse{Id: r.Seq}
 	if r.Error == 0 {
 		resp.Result = x
@@ -93,6 +99,14 @@ func (c *ServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
 	return c.enc.Encode(resp)
 }
 
+// RemoteAddr returns the peer address if the codec serves a net.Conn.
+func (c *ServerCodec) RemoteAddr() net.Addr {
+	if conn, ok := c.c.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
 func (c *ServerCodec) Close() error {
 	return c.c.Close()
 }
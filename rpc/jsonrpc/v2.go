@@ -0,0 +1,510 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	rpc "github.com/lijie/go/rpc"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Error codes defined by the JSON-RPC 2.0 specification.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// The errors of the calls failing with the codes above, except
+// CodeInternalError, which is rpc.ErrInternal.  Negative codes are
+// carried in two's complement, so that int32(code) gives them back.
+const (
+	ErrParse          rpc.Error = 1<<32 + CodeParseError
+	ErrInvalidRequest rpc.Error = 1<<32 + CodeInvalidRequest
+	ErrMethodNotFound rpc.Error = 1<<32 + CodeMethodNotFound
+	ErrInvalidParams  rpc.Error = 1<<32 + CodeInvalidParams
+)
+
+// errorCode returns the rpc error code for a JSON-RPC error code.
+func errorCode(code int64) uint32 {
+	switch {
+	case code == CodeInternalError:
+		return uint32(rpc.ErrInternal)
+	case code > 0 && code < math.MaxUint32:
+		return uint32(code)
+	case code < 0 && code >= math.MinInt32:
+		return uint32(int32(code))
+	}
+	return uint32(rpc.ErrInternal)
+}
+
+// A Registry maps JSON-RPC method names to rpc cmds.
+// It is safe for concurrent use.
+type Registry struct {
+	mu    sync.RWMutex
+	cmds  map[string]uint32
+	names map[uint32]string
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		cmds:  make(map[string]uint32),
+		names: make(map[uint32]string),
+	}
+}
+
+// Register maps the method name to cmd, in both directions.
+func (r *Registry) Register(name string, cmd uint32) {
+	r.mu.Lock()
+	r.cmds[name] = cmd
+	r.names[cmd] = name
+	r.mu.Unlock()
+}
+
+// Cmd returns the cmd registered for the method name.
+func (r *Registry) Cmd(name string) (uint32, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.cmds[name]
+	return cmd, ok
+}
+
+// Name returns the method name registered for cmd.
+func (r *Registry) Name(cmd uint32) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, ok := r.names[cmd]
+	return name, ok
+}
+
+type errorObject struct {
+	Code    int64           `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// v2Request is a request or, without Id, a notification.
+type v2Request struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      json.RawMessage `json:"id,omitempty"`
+}
+
+type v2Response struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *errorObject    `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+var nullId = json.RawMessage("null")
+
+func errorResponse(id json.RawMessage, code int64, message string) *v2Response {
+	if id == nil {
+		id = nullId
+	}
+	return &v2Response{Version: "2.0", Error: &errorObject{Code: code, Message: message}, Id: id}
+}
+
+// marshalParams encodes x as by-position params with a single element.
+func marshalParams(x interface{}) (json.RawMessage, error) {
+	return json.Marshal([1]interface{}{x})
+}
+
+// unmarshalParams decodes params into x.  By-position params holding a
+// single element are decoded from that element, other params as a whole.
+func unmarshalParams(params json.RawMessage, x interface{}) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 {
+		return nil
+	}
+	if params[0] == '[' {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(params, &elems); err != nil {
+			return err
+		}
+		if len(elems) == 1 {
+			return json.Unmarshal(elems[0], x)
+		}
+	}
+	return json.Unmarshal(params, x)
+}
+
+// v2Call is a request read by the server codec and not yet answered.
+type v2Call struct {
+	cmd       uint32
+	seq       uint32
+	id        json.RawMessage // nil for a notification
+	params    json.RawMessage
+	batch     *v2Batch
+	badParams bool
+}
+
+// v2Batch collects the responses to the calls of a batch request.
+type v2Batch struct {
+	remaining int
+	resps     []*v2Response
+}
+
+type serverCodecV2 struct {
+	dec *json.Decoder // for reading JSON values
+	c   io.Closer
+	reg *Registry
+
+	// read side only
+	queue []*v2Call
+	cur   *v2Call
+
+	mu      sync.Mutex    // protects following
+	enc     *json.Encoder // for writing JSON values
+	seq     uint32
+	pending map[uint32]*v2Call
+}
+
+// NewServerCodecV2 returns a new rpc.ServerCodec speaking JSON-RPC 2.0 on
+// conn.  Method names are mapped to cmds with reg.  Notifications are
+// dispatched but never answered, and batches are answered with a single
+// array once all their calls have returned.
+func NewServerCodecV2(conn io.ReadWriteCloser, reg *Registry) rpc.ServerCodec {
+	return &serverCodecV2{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		reg:     reg,
+		pending: make(map[uint32]*v2Call),
+	}
+}
+
+func (c *serverCodecV2) ReadRequestHeader(r *rpc.Request) error {
+	for len(c.queue) == 0 {
+		var raw json.RawMessage
+		if err := c.dec.Decode(&raw); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				c.write(errorResponse(nil, CodeParseError, "parse error"))
+			}
+			return err
+		}
+		c.parse(raw)
+	}
+	c.cur = c.queue[0]
+	c.queue = c.queue[1:]
+	r.Cmd = c.cur.cmd
+	r.Seq = c.cur.seq
+	return nil
+}
+
+// parse queues the calls of a request or batch, and answers the invalid
+// ones right away.
+func (c *serverCodecV2) parse(raw json.RawMessage) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '[' {
+		call, resp := c.parseOne(raw, nil)
+		if call != nil {
+			c.queue = append(c.queue, call)
+		} else if resp != nil {
+			c.write(resp)
+		}
+		return
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err != nil || len(elems) == 0 {
+		c.write(errorResponse(nil, CodeInvalidRequest, "invalid request"))
+		return
+	}
+	b := new(v2Batch)
+	c.mu.Lock()
+	for _, elem := range elems {
+		call, resp := c.parseOne(elem, b)
+		if call != nil {
+			c.queue = append(c.queue, call)
+			b.remaining++
+		} else if resp != nil {
+			b.resps = append(b.resps, resp)
+		}
+	}
+	done := b.remaining == 0 && len(b.resps) > 0
+	c.mu.Unlock()
+	if done {
+		c.write(b.resps)
+	}
+}
+
+// parseOne returns the call for a single request, or the response to
+// send if it is invalid.  It returns neither for an invalid notification.
+func (c *serverCodecV2) parseOne(raw json.RawMessage, b *v2Batch) (*v2Call, *v2Response) {
+	var req v2Request
+	if err := json.Unmarshal(raw, &req); err != nil || req.Version != "2.0" || req.Method == "" {
+		return nil, errorResponse(req.Id, CodeInvalidRequest, "invalid request")
+	}
+	cmd, ok := c.reg.Cmd(req.Method)
+	if !ok {
+		if req.Id == nil {
+			return nil, nil
+		}
+		return nil, errorResponse(req.Id, CodeMethodNotFound, "method not found")
+	}
+	call := &v2Call{cmd: cmd, id: req.Id, params: req.Params, batch: b}
+	if b == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	}
+	for {
+		c.seq++
+		if _, ok := c.pending[c.seq]; c.seq != 0 && !ok {
+			break
+		}
+	}
+	call.seq = c.seq
+	c.pending[call.seq] = call
+	return call, nil
+}
+
+func (c *serverCodecV2) write(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(v)
+}
+
+func (c *serverCodecV2) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	err := unmarshalParams(c.cur.params, x)
+	if err != nil {
+		c.mu.Lock()
+		c.cur.badParams = true
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *serverCodecV2) WriteResponse(r *rpc.Response, x interface{}) error {
+	if r.Kind != rpc.KindCall {
+		// JSON-RPC has no control frames.
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.Seq == 0 {
+		// A notification pushed by the server.
+		name, ok := c.reg.Name(r.Cmd)
+		if !ok {
+			return fmt.Errorf("jsonrpc: no method name for cmd %d", r.Cmd)
+		}
+		params, err := marshalParams(x)
+		if err != nil {
+			return err
+		}
+		return c.enc.Encode(v2Request{Version: "2.0", Method: name, Params: params})
+	}
+
+	call := c.pending[r.Seq]
+	if call == nil {
+		return errors.New("jsonrpc: invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+
+	var resp *v2Response
+	if call.id != nil {
+		resp = &v2Response{Version: "2.0", Id: call.id}
+		switch {
+		case call.badParams:
+			resp.Error = &errorObject{Code: CodeInvalidParams, Message: "invalid params"}
+		case r.Error != 0:
+			resp.Error = &errorObject{Code: int64(r.Error), Message: rpc.Error(r.Error).Error()}
+			if code := int32(r.Error); r.Error == math.MaxUint32 {
+				resp.Error.Code = CodeInternalError
+			} else if code >= -32768 && code <= -32000 {
+				// Such as ErrMethodNotFound: the codes reserved by the
+				// specification.
+				resp.Error.Code = int64(code)
+			}
+			if status, ok := x.(*rpc.StatusError); ok && r.ErrorBody {
+				if status.Message != "" {
+					resp.Error.Message = status.Message
+				}
+				if len(status.Details) > 0 {
+					resp.Error.Data, _ = json.Marshal(status.Details)
+				}
+			}
+		default:
+			result, err := json.Marshal(x)
+			if err != nil {
+				resp.Error = &errorObject{Code: CodeInternalError, Message: err.Error()}
+			} else {
+				resp.Result = result
+			}
+		}
+	}
+
+	b := call.batch
+	if b == nil {
+		if resp == nil {
+			return nil
+		}
+		return c.enc.Encode(resp)
+	}
+	if resp != nil {
+		b.resps = append(b.resps, resp)
+	}
+	b.remaining--
+	if b.remaining > 0 || len(b.resps) == 0 {
+		return nil
+	}
+	return c.enc.Encode(b.resps)
+}
+
+// RemoteAddr returns the peer address if the codec serves a net.Conn.
+func (c *serverCodecV2) RemoteAddr() net.Addr {
+	if conn, ok := c.c.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *serverCodecV2) Close() error {
+	return c.c.Close()
+}
+
+// ServeConnV2 runs the JSON-RPC 2.0 server on a single connection.
+// ServeConnV2 blocks, serving the connection until the client hangs up.
+// The caller typically invokes ServeConnV2 in a go statement.
+func ServeConnV2(conn io.ReadWriteCloser, reg *Registry) {
+	rpc.ServeCodec(NewServerCodecV2(conn, reg))
+}
+
+// v2Message is a response or a notification read by the client codec.
+type v2Message struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *errorObject    `json:"error"`
+	Id     json.RawMessage `json:"id"`
+}
+
+type clientCodecV2 struct {
+	dec *json.Decoder // for reading JSON values
+	enc *json.Encoder // for writing JSON values
+	c   io.Closer
+	reg *Registry
+
+	// temporary work space
+	msg v2Message
+}
+
+// NewClientCodecV2 returns a new rpc.ClientCodec speaking JSON-RPC 2.0 on
+// conn.  Cmds are mapped to method names with reg.  Notifications sent by
+// the server are delivered as rpc notifications.  Error responses with a
+// message other than their code, or with data, fail their call with an
+// *rpc.StatusError holding the code, see ErrParse, the message and, if it
+// is an object of strings, the data as details.
+func NewClientCodecV2(conn io.ReadWriteCloser, reg *Registry) rpc.ClientCodec {
+	return &clientCodecV2{
+		dec: json.NewDecoder(conn),
+		enc: json.NewEncoder(conn),
+		c:   conn,
+		reg: reg,
+	}
+}
+
+func (c *clientCodecV2) WriteRequest(r *rpc.Request, x interface{}) error {
+	if r.Kind == rpc.KindStream || r.Kind == rpc.KindDuplex {
+		return rpc.ErrNoStreams
+	}
+	if r.Kind == rpc.KindHello {
+		return rpc.ErrNoMetadata
+	}
+	if r.Kind != rpc.KindCall {
+		// JSON-RPC has no control frames.
+		return nil
+	}
+	name, ok := c.reg.Name(r.Cmd)
+	if !ok {
+		return fmt.Errorf("jsonrpc: no method name for cmd %d", r.Cmd)
+	}
+	params, err := marshalParams(x)
+	if err != nil {
+		return err
+	}
+	id := strconv.AppendUint(nil, uint64(r.Seq), 10)
+	return c.enc.Encode(v2Request{Version: "2.0", Method: name, Params: params, Id: id})
+}
+
+func (c *clientCodecV2) ReadResponseHeader(r *rpc.Response) error {
+	c.msg = v2Message{}
+	if err := c.dec.Decode(&c.msg); err != nil {
+		return err
+	}
+	r.Cmd = 0
+	r.Seq = 0
+	r.Error = 0
+	r.ErrorBody = false
+	if c.msg.Method != "" && c.msg.Id == nil {
+		// A notification; unknown methods map to cmd 0 and are dropped.
+		r.Cmd, _ = c.reg.Cmd(c.msg.Method)
+		return nil
+	}
+	var seq uint32
+	if err := json.Unmarshal(c.msg.Id, &seq); err != nil {
+		return fmt.Errorf("jsonrpc: invalid response id %s", c.msg.Id)
+	}
+	r.Seq = seq
+	if e := c.msg.Error; e != nil {
+		r.Error = errorCode(e.Code)
+		// The message of an error only made of a code is the code.
+		r.ErrorBody = e.Message != rpc.Error(r.Error).Error() || len(e.Data) > 0
+	}
+	return nil
+}
+
+func (c *clientCodecV2) ReadResponseBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	if c.msg.Method != "" && c.msg.Id == nil {
+		return unmarshalParams(c.msg.Params, x)
+	}
+	if e := c.msg.Error; e != nil {
+		if status, ok := x.(*rpc.StatusError); ok {
+			status.Message = e.Message
+			if len(e.Data) > 0 && json.Unmarshal(e.Data, &status.Details) != nil {
+				status.Details = map[string]string{"data": string(e.Data)}
+			}
+		}
+		return nil
+	}
+	if c.msg.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(c.msg.Result, x)
+}
+
+func (c *clientCodecV2) Close() error {
+	return c.c.Close()
+}
+
+// NewClientV2 returns a new rpc.Client speaking JSON-RPC 2.0 to the
+// set of services at the other end of the connection.
+func NewClientV2(conn io.ReadWriteCloser, reg *Registry) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodecV2(conn, reg))
+}
+
+// DialV2 connects to a JSON-RPC 2.0 server at the specified network address.
+func DialV2(network, address string, reg *Registry) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientV2(conn, reg), nil
+}
@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout fails the calls pending on a connection closed because
+// nothing was read from the peer within the idle timeout.
+var ErrIdleTimeout = errors.New("rpc: peer idle timeout")
+
+// Keepalive configures liveness detection on the connections of a Client
+// or Server.  The zero value disables it.
+//
+// Pings need a codec carrying the frame kinds, as the gob, msgpack and
+// proto codecs do; with other codecs only the idle timeout and lifetime
+// apply, so IdleTimeout must exceed the time the connection may stay
+// unused.
+type Keepalive struct {
+	// Interval is how long the connection may go without reading from
+	// the peer before a ping is sent.  0 disables pings.
+	Interval time.Duration
+	// IdleTimeout is how long the connection may go without reading from
+	// the peer, pongs included, before it is closed.  It should be a few
+	// Intervals long.  0 for no limit.
+	IdleTimeout time.Duration
+	// MaxLifetime is the age past which the connection is closed as soon
+	// as it has no call in flight.  0 for no limit.
+	MaxLifetime time.Duration
+}
+
+func (k Keepalive) enabled() bool {
+	return k.Interval > 0 || k.IdleTimeout > 0 || k.MaxLifetime > 0
+}
+
+// tick returns how often the watchdog checks the connection.
+func (k Keepalive) tick() time.Duration {
+	d := time.Duration(0)
+	for _, v := range []time.Duration{k.Interval, k.IdleTimeout, k.MaxLifetime} {
+		if v > 0 && (d == 0 || v < d) {
+			d = v
+		}
+	}
+	d /= 4
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// watchdog enforces a Keepalive on a connection.
+type watchdog struct {
+	lastRead int64 // UnixNano of the last frame read, accessed atomically
+	pinging  int32 // non-zero while a ping is being written, accessed atomically
+	done     chan struct{}
+}
+
+func newWatchdog() *watchdog {
+	return &watchdog{lastRead: time.Now().UnixNano(), done: make(chan struct{})}
+}
+
+// read records that a frame was read from the peer.
+func (w *watchdog) read() {
+	atomic.StoreInt64(&w.lastRead, time.Now().UnixNano())
+}
+
+// stop makes run return.
+func (w *watchdog) stop() {
+	close(w.done)
+}
+
+// run checks the connection started at start until stop is called.  ping
+// writes a ping to the peer, idle reports whether no call is in flight,
+// and close closes the connection, failing its calls with err.
+func (w *watchdog) run(k Keepalive, start time.Time, ping func(), idle func() bool, close func(err error)) {
+	t := time.NewTicker(k.tick())
+	defer t.Stop()
+	var lastPing time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-t.C:
+			last := time.Unix(0, atomic.LoadInt64(&w.lastRead))
+			if k.IdleTimeout > 0 && now.Sub(last) >= k.IdleTimeout {
+				close(ErrIdleTimeout)
+				return
+			}
+			if k.MaxLifetime > 0 && now.Sub(start) >= k.MaxLifetime && idle() {
+				close(ErrShutdown)
+				return
+			}
+			if k.Interval > 0 && now.Sub(last) >= k.Interval && now.Sub(lastPing) >= k.Interval {
+				lastPing = now
+				// A dead peer may block the write; closing the
+				// connection unblocks it.
+				if atomic.CompareAndSwapInt32(&w.pinging, 0, 1) {
+					go func() {
+						ping()
+						atomic.StoreInt32(&w.pinging, 0)
+					}()
+				}
+			}
+		}
+	}
+}
+
+// SetKeepalive sets the liveness checks of the connection, replacing the
+// previous ones.  When the idle timeout expires, the pending calls fail
+// with ErrIdleTimeout.
+func (client *Client) SetKeepalive(k Keepalive) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.watchdog != nil {
+		client.watchdog.stop()
+		client.watchdog = nil
+	}
+	if client.shutdown || !k.enabled() {
+		return
+	}
+	wd := newWatchdog()
+	client.watchdog = wd
+	go wd.run(k, client.started, client.ping, client.idle, client.closeWith)
+}
+
+// ping asks the server for a pong.
+func (client *Client) ping() {
+	client.writeFrame(Request{Kind: KindPing}, invalidRequest)
+}
+
+// idle reports whether the client has no call or stream in flight.
+func (client *Client) idle() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return len(client.pending) == 0 && len(client.streams) == 0
+}
+
+// closeWith closes the client, failing the pending calls with err.
+func (client *Client) closeWith(err error) {
+	client.mutex.Lock()
+	if client.closing || client.shutdown {
+		client.mutex.Unlock()
+		return
+	}
+	client.closing = true
+	client.closeErr = err
+	client.mutex.Unlock()
+	client.codec.Close()
+}
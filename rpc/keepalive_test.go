@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveDeadServer(t *testing.T) {
+	// The server reads everything and never answers.
+	cli, srv := net.Pipe()
+	go io.Copy(io.Discard, srv)
+	defer srv.Close()
+	c := NewClient(cli)
+	c.SetKeepalive(Keepalive{Interval: 10 * time.Millisecond, IdleTimeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	reply := 0
+	if err := c.Call(100, &AddParams{1, 2}, &reply); err != ErrIdleTimeout {
+		t.Fatal("call to a dead server returned", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("dead server detected after", d)
+	}
+}
+
+func TestKeepaliveIdleConnection(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	server.SetKeepalive(Keepalive{Interval: 10 * time.Millisecond, IdleTimeout: 50 * time.Millisecond})
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+	c.SetKeepalive(Keepalive{Interval: 10 * time.Millisecond, IdleTimeout: 50 * time.Millisecond})
+
+	// Pings keep both sides happy while the connection is unused.
+	time.Sleep(200 * time.Millisecond)
+	reply := 0
+	if err := c.Call(100, &AddParams{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepaliveServer(t *testing.T) {
+	server := NewServer()
+	server.SetKeepalive(Keepalive{Interval: 10 * time.Millisecond, IdleTimeout: 50 * time.Millisecond})
+
+	// The client reads everything and never writes.
+	cli, srv := net.Pipe()
+	go io.Copy(io.Discard, cli)
+	defer cli.Close()
+	served := make(chan struct{})
+	go func() {
+		server.ServeConn(context.Background(), srv)
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("server kept a dead client connection")
+	}
+
+	// A connection past its lifetime is closed once idle.
+	server.SetKeepalive(Keepalive{MaxLifetime: 50 * time.Millisecond})
+	if err := server.Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv = net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+	reply := 0
+	if err := c.Call(100, &AddParams{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.dead:
+	case <-time.After(time.Second):
+		t.Fatal("server kept a connection past its lifetime")
+	}
+}
@@ -0,0 +1,174 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ProtocolVersion is the highest version of the protocol this package
+// speaks.  Client and server agree on a version with a KindHello frame
+// before the first call carrying metadata; clients that send none stick
+// to version 0 and never send the hello.  Version 0 is the bare header;
+// version 1 adds metadata, including the reply metadata.
+const ProtocolVersion = 1
+
+// ErrNoMetadata is returned by the codecs that cannot carry metadata when
+// asked to write a KindHello frame, so that the client falls back to
+// version 0 right away.
+var ErrNoMetadata = errors.New("rpc: codec cannot carry metadata")
+
+// Metadata holds key/value pairs sent along with a call or its reply,
+// such as a trace ID, the identity of the caller or a locale.  Metadata
+// is dropped on connections to peers that predate it.
+type Metadata map[string]string
+
+// merge returns the union of md and other, other winning on conflicts.
+// It returns md or other as is if the other one is empty.
+func (md Metadata) merge(other Metadata) Metadata {
+	if len(other) == 0 {
+		return md
+	}
+	if len(md) == 0 {
+		return other
+	}
+	m := make(Metadata, len(md)+len(other))
+	for k, v := range md {
+		m[k] = v
+	}
+	for k, v := range other {
+		m[k] = v
+	}
+	return m
+}
+
+type outgoingKey struct{}
+
+// WithMetadata returns a copy of ctx carrying md, on top of the metadata
+// ctx already carries.  The calls made with the returned context send
+// that metadata to the server.
+//
+// The first call carrying metadata on a connection is preceded by a
+// KindHello frame.  A server that predates it takes it for a call to
+// cmd 0, so if such a server has a handler registered for cmd 0, that
+// handler runs once.  Don't use metadata with such servers.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, outgoingMetadata(ctx).merge(md))
+}
+
+func outgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingKey{}).(Metadata)
+	return md
+}
+
+// callMetadata is the metadata of a call being served.
+type callMetadata struct {
+	incoming Metadata
+
+	mu    sync.Mutex // protects reply
+	reply Metadata
+}
+
+type callMetadataKey struct{}
+
+// IncomingMetadata returns the metadata the client sent with the call a
+// handler's context belongs to.  It must not be modified.
+func IncomingMetadata(ctx context.Context) Metadata {
+	if cm, ok := ctx.Value(callMetadataKey{}).(*callMetadata); ok {
+		return cm.incoming
+	}
+	return nil
+}
+
+// SetReplyMetadata adds key and value to the metadata sent with the reply
+// to the call a handler's context belongs to.  It does nothing if the
+// client cannot receive metadata.
+func SetReplyMetadata(ctx context.Context, key, value string) {
+	cm, ok := ctx.Value(callMetadataKey{}).(*callMetadata)
+	if !ok {
+		return
+	}
+	cm.mu.Lock()
+	if cm.reply == nil {
+		cm.reply = make(Metadata)
+	}
+	cm.reply[key] = value
+	cm.mu.Unlock()
+}
+
+func replyMetadata(ctx context.Context) Metadata {
+	cm, ok := ctx.Value(callMetadataKey{}).(*callMetadata)
+	if !ok {
+		return nil
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.reply
+}
+
+// protocolVersion returns the protocol version agreed with the client.
+func (c *Conn) protocolVersion() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// handshake writes the hello.  It runs once, before the first call
+// carrying metadata is sent.
+func (client *Client) handshake() {
+	client.reqMutex.Lock()
+	client.mutex.Lock()
+	seq := client.nextSeq()
+	client.helloSeq = seq
+	client.mutex.Unlock()
+	client.request = Request{Seq: seq, Kind: KindHello, Version: ProtocolVersion}
+	err := client.codec.WriteRequest(&client.request, invalidRequest)
+	client.reqMutex.Unlock()
+	if err != nil {
+		client.negotiated(0)
+	}
+}
+
+// helloReply reports whether r answers the hello as a call, as servers
+// that predate KindHello do.  The hello has a seq of its own, so that
+// such answers are not mistaken for notifications or other replies.
+func (client *Client) helloReply(r *Response) bool {
+	if r.Kind != KindCall || r.Seq == 0 {
+		return false
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return r.Seq == client.helloSeq
+}
+
+// negotiated records the protocol version chosen by the server, unless
+// it is already known.
+func (client *Client) negotiated(version uint32) {
+	select {
+	case <-client.hello:
+		return
+	default:
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	select {
+	case <-client.hello:
+		return
+	default:
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	client.version = version
+	client.helloSeq = 0
+	close(client.hello)
+}
+
+// ProtocolVersion returns the protocol version agreed with the server, 0
+// until a call carrying metadata has sent the hello and the server has
+// answered it.
+func (client *Client) ProtocolVersion() uint32 {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.version
+}
@@ -0,0 +1,236 @@
+package rpc
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoMetadata replies with the sum and sends the "user" metadata back
+// as "greeting".
+func echoMetadata(ctx context.Context, arg *Pair, reply *Pair) error {
+	if user := IncomingMetadata(ctx)["user"]; user != "" {
+		SetReplyMetadata(ctx, "greeting", "hello "+user)
+	}
+	*reply = *arg
+	return nil
+}
+
+func TestMetadata(t *testing.T) {
+	gob := NewServer()
+	if err := gob.Register(1, echoMetadata); err != nil {
+		t.Fatal(err)
+	}
+	proto := NewProtoServer()
+	if err := proto.Register(1, echoMetadata); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go gob.ServeConn(context.Background(), srv)
+	gobClient := NewClient(cli)
+	defer gobClient.Close()
+	cli, srv = net.Pipe()
+	go proto.ServeProtoConn(context.Background(), srv)
+	protoClient := NewProtoClient(cli)
+	defer protoClient.Close()
+
+	for _, c := range []*Client{gobClient, protoClient} {
+		ctx := WithMetadata(context.Background(), Metadata{"user": "bob", "locale": "fr"})
+		ctx = WithMetadata(ctx, Metadata{"user": "alice"})
+		var reply Pair
+		call := <-c.GoContext(ctx, 1, &Pair{1, 2}, &reply, make(chan *Call, 1)).Done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+		if got := call.ReplyMetadata["greeting"]; got != "hello alice" {
+			t.Fatalf("reply metadata %v", call.ReplyMetadata)
+		}
+		if v := c.ProtocolVersion(); v != ProtocolVersion {
+			t.Fatal("negotiated version", v)
+		}
+
+		// Metadata set on the call itself, through an interceptor.
+		c.Use(func(ctx context.Context, call *Call, next Invoker) error {
+			call.Metadata = Metadata{"user": "carol"}
+			err := next(ctx, call)
+			if call.ReplyMetadata["greeting"] != "hello carol" {
+				t.Errorf("interceptor sees reply metadata %v", call.ReplyMetadata)
+			}
+			return err
+		})
+		if err := c.Call(1, &Pair{1, 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// legacyRequest and legacyResponse are the gob headers of the peers that
+// predate KindHello.
+type legacyRequest struct {
+	Cmd, Seq uint32
+}
+
+type legacyResponse struct {
+	Cmd, Seq, Error uint32
+}
+
+// serveLegacy answers the calls read from conn as a server that predates
+// KindHello does: every cmd echoes its Pair.  cmd 0 is unknown if zero is
+// nil, and counts its calls in zero otherwise.
+func serveLegacy(conn net.Conn, zero *int32) {
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+	for {
+		var req legacyRequest
+		if dec.Decode(&req) != nil {
+			return
+		}
+		var arg Pair
+		if req.Cmd == 0 && zero == nil {
+			dec.Decode(&struct{}{})
+			enc.Encode(&legacyResponse{Cmd: req.Cmd, Seq: req.Seq, Error: uint32(ErrInternal)})
+			enc.Encode(invalidRequest)
+			continue
+		}
+		if err := dec.Decode(&arg); err != nil {
+			// As the server reports a body it cannot decode.
+			enc.Encode(&legacyResponse{Cmd: req.Cmd, Seq: req.Seq, Error: uint32(ErrInternal)})
+			enc.Encode(invalidRequest)
+			continue
+		}
+		if req.Cmd == 0 {
+			atomic.AddInt32(zero, 1)
+		}
+		enc.Encode(&legacyResponse{Cmd: req.Cmd, Seq: req.Seq})
+		enc.Encode(&arg)
+	}
+}
+
+func TestMetadataLegacyServer(t *testing.T) {
+	cli, srv := net.Pipe()
+	go serveLegacy(srv, nil)
+	defer srv.Close()
+	c := NewClient(cli)
+	defer c.Close()
+
+	ctx := WithMetadata(context.Background(), Metadata{"user": "bob"})
+	var reply Pair
+	if err := c.CallContext(ctx, 1, &Pair{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != (Pair{1, 2}) {
+		t.Fatal("reply", reply)
+	}
+	if v := c.ProtocolVersion(); v != 0 {
+		t.Fatal("negotiated version", v)
+	}
+}
+
+// TestMetadataLegacyServerCmdZero checks that a client sending no
+// metadata does not reach the cmd 0 handler of a server that predates
+// KindHello, and that metadata falls back to version 0 with it.
+func TestMetadataLegacyServerCmdZero(t *testing.T) {
+	cli, srv := net.Pipe()
+	var zero int32
+	go serveLegacy(srv, &zero)
+	defer srv.Close()
+	c := NewClient(cli)
+	defer c.Close()
+
+	for i := uint32(0); i < 3; i++ {
+		var reply Pair
+		if err := c.Call(1, &Pair{1, i}, &reply); err != nil || reply != (Pair{1, i}) {
+			t.Fatal("call:", reply, err)
+		}
+	}
+	if n := atomic.LoadInt32(&zero); n != 0 {
+		t.Fatalf("cmd 0 called %d times by a client without metadata", n)
+	}
+
+	ctx := WithMetadata(context.Background(), Metadata{"user": "bob"})
+	var reply Pair
+	if err := c.CallContext(ctx, 1, &Pair{3, 4}, &reply); err != nil || reply != (Pair{3, 4}) {
+		t.Fatal("call with metadata:", reply, err)
+	}
+	if v := c.ProtocolVersion(); v != 0 {
+		t.Fatal("negotiated version", v)
+	}
+}
+
+// TestMetadataNotifyBeforeHello checks that a notification for cmd 0
+// arriving before the answer to the hello is not taken for the answer of
+// a server that predates KindHello.
+func TestMetadataNotifyBeforeHello(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer srv.Close()
+	go func() {
+		dec := gob.NewDecoder(srv)
+		enc := gob.NewEncoder(srv)
+		for {
+			var req Request
+			if dec.Decode(&req) != nil {
+				return
+			}
+			var arg Pair
+			if req.Kind == KindHello {
+				dec.Decode(&struct{}{})
+				enc.Encode(&Response{})
+				enc.Encode(&Pair{})
+				enc.Encode(&Response{Kind: KindHello, Version: ProtocolVersion})
+				enc.Encode(invalidRequest)
+				continue
+			}
+			dec.Decode(&arg)
+			enc.Encode(&Response{Cmd: req.Cmd, Seq: req.Seq, Metadata: req.Metadata})
+			enc.Encode(&arg)
+		}
+	}()
+	c := NewClient(cli)
+	defer c.Close()
+	notified := make(chan struct{}, 1)
+	c.OnNotify(0, Pair{}, func(cmd uint32, body interface{}) { notified <- struct{}{} })
+
+	ctx := WithMetadata(context.Background(), Metadata{"user": "bob"})
+	var reply Pair
+	if err := c.CallContext(ctx, 1, &Pair{1, 2}, &reply); err != nil || reply != (Pair{1, 2}) {
+		t.Fatal("call:", reply, err)
+	}
+	if v := c.ProtocolVersion(); v != ProtocolVersion {
+		t.Fatal("negotiated version", v)
+	}
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("notification not delivered")
+	}
+}
+
+// TestMetadataHelloUnanswered checks that Close fails a call waiting for
+// the answer to the hello.
+func TestMetadataHelloUnanswered(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer srv.Close()
+	go io.Copy(io.Discard, srv)
+	c := NewClient(cli)
+
+	ctx := WithMetadata(context.Background(), Metadata{"user": "bob"})
+	call := c.GoContext(ctx, 1, &Pair{1, 2}, new(Pair), nil)
+	select {
+	case <-call.Done:
+		t.Fatal("call completed before the hello was answered:", call.Error)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Close()
+	select {
+	case <-call.Done:
+		if call.Error != ErrShutdown {
+			t.Fatal("call returned", call.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call still waiting after Close")
+	}
+}
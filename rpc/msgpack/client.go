@@ -0,0 +1,75 @@
+package msgpack
+
+import (
+	"io"
+	"net"
+
+	rpc "github.com/lijie/go/rpc"
+)
+
+type clientCodec struct {
+	c   io.ReadWriteCloser
+	dec *Decoder
+	out *frameWriter
+
+	// temporary work space
+	hdr [7]uint32
+}
+
+// NewClientCodec returns a new rpc.ClientCodec using MessagePack on conn.
+func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &clientCodec{
+		c:   conn,
+		dec: NewDecoder(conn),
+		out: newFrameWriter(conn),
+	}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, x interface{}) error {
+	return c.out.writeFrame([]uint32{r.Cmd, r.Seq, uint32(r.Kind), r.Timeout, r.Window, r.Error, r.Version}, r.Metadata, x)
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.dec.readHeader(c.hdr[:], &r.Metadata); err != nil {
+		return err
+	}
+	r.Cmd = c.hdr[0]
+	r.Seq = c.hdr[1]
+	r.Error = c.hdr[2]
+	r.Kind = uint8(c.hdr[3])
+	r.Window = c.hdr[4]
+	r.ErrorBody = c.hdr[5] != 0
+	r.Version = c.hdr[6]
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(x interface{}) error {
+	return c.dec.Decode(x)
+}
+
+// RemoteAddr returns the peer address if the codec runs on a net.Conn.
+func (c *clientCodec) RemoteAddr() net.Addr {
+	if conn, ok := c.c.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *clientCodec) Close() error {
+	return c.c.Close()
+}
+
+// NewClient returns a new rpc.Client to handle requests to the
+// set of services at the other end of the connection.
+func NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodec(conn))
+}
+
+// Dial connects to a MessagePack RPC server at the specified network address.
+func Dial(network, address string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
@@ -0,0 +1,116 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	rpc "github.com/lijie/go/rpc"
+)
+
+// writeHeader writes fields as an array of unsigned integers, followed by
+// md as a map if it is not empty.
+func (e *Encoder) writeHeader(fields []uint32, md rpc.Metadata) error {
+	n := len(fields)
+	if len(md) > 0 {
+		n++
+	}
+	if err := e.writeLength(n, 0x90, 15, 0, mpArray16, mpArray32); err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err := e.encodeUint(uint64(f)); err != nil {
+			return err
+		}
+	}
+	if len(md) > 0 {
+		return e.Encode(md)
+	}
+	return nil
+}
+
+// readHeader reads an array of unsigned integers into fields, and the map
+// following them into md.  Missing elements are set to zero and extra ones
+// are skipped.
+func (d *Decoder) readHeader(fields []uint32, md *rpc.Metadata) error {
+	val, err := d.next()
+	if err != nil {
+		return err
+	}
+	if val.kind != kArray {
+		return fmt.Errorf("msgpack: header is %s, not array", kindNames[val.kind])
+	}
+	for i := range fields {
+		fields[i] = 0
+	}
+	*md = nil
+	for i := 0; i < val.n; i++ {
+		if i == len(fields) {
+			if err := d.Decode(md); err != nil {
+				return err
+			}
+			continue
+		}
+		if i > len(fields) {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		elem, err := d.next()
+		if err != nil {
+			return err
+		}
+		if elem.kind != kUint || elem.u > 1<<32-1 {
+			return fmt.Errorf("msgpack: invalid header field %d", i)
+		}
+		fields[i] = uint32(elem.u)
+	}
+	return nil
+}
+
+// A frameWriter encodes each frame into a scratch buffer and writes it
+// to w only once the whole frame has encoded, so a body that fails to
+// encode leaves nothing behind on the connection.
+type frameWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+	bw  *bufio.Writer
+	enc *Encoder
+}
+
+func newFrameWriter(w io.Writer) *frameWriter {
+	f := &frameWriter{w: w}
+	f.bw = bufio.NewWriter(&f.buf)
+	f.enc = NewEncoder(f.bw)
+	return f
+}
+
+// encode encodes a header and body into the scratch buffer, discarding
+// whatever a previous call left there.
+func (f *frameWriter) encode(fields []uint32, md rpc.Metadata, body interface{}) error {
+	f.buf.Reset()
+	f.bw.Reset(&f.buf)
+	if err := f.enc.writeHeader(fields, md); err != nil {
+		return err
+	}
+	if err := f.enc.Encode(body); err != nil {
+		return err
+	}
+	return f.bw.Flush()
+}
+
+// flush writes the encoded frame to the connection.
+func (f *frameWriter) flush() error {
+	_, err := f.w.Write(f.buf.Bytes())
+	return err
+}
+
+// writeFrame writes a header and body as a unit.
+func (f *frameWriter) writeFrame(fields []uint32, md rpc.Metadata, body interface{}) error {
+	if err := f.encode(fields, md, body); err != nil {
+		return err
+	}
+	return f.flush()
+}
@@ -0,0 +1,865 @@
+// Package msgpack implements a MessagePack ClientCodec and ServerCodec
+// for the rpc package, along with the MessagePack encoder and decoder
+// they are built on.
+//
+// Each request is written as a MessagePack array
+// [cmd, seq, kind, timeout, window, error, version, metadata] followed by
+// the argument, and each response as an array
+// [cmd, seq, error, kind, window, errorBody, version, metadata] followed by
+// the reply, or by an rpc.StatusError if errorBody is 1.  metadata is a
+// map, left out when empty.  Shorter header arrays are accepted, missing
+// fields being zero, and extra elements are ignored.
+//
+// Values are mapped as follows: booleans, integers, floats and strings to
+// the corresponding MessagePack types, []byte to bin, slices and arrays
+// to arrays, maps to maps, and structs to maps keyed by field name.  The
+// key of a struct field can be changed with a `msgpack:"name"` tag, and
+// a field tagged `msgpack:"-"` is skipped.  When decoding into an empty
+// interface, integers become int64 or uint64, floats float64, strings
+// string, bin []byte, arrays []interface{} and maps
+// map[interface{}]interface{}.
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Format bytes.
+const (
+	mpNil      = 0xc0
+	mpFalse    = 0xc2
+	mpTrue     = 0xc3
+	mpBin8     = 0xc4
+	mpBin16    = 0xc5
+	mpBin32    = 0xc6
+	mpExt8     = 0xc7
+	mpExt16    = 0xc8
+	mpExt32    = 0xc9
+	mpFloat32  = 0xca
+	mpFloat64  = 0xcb
+	mpUint8    = 0xcc
+	mpUint16   = 0xcd
+	mpUint32   = 0xce
+	mpUint64   = 0xcf
+	mpInt8     = 0xd0
+	mpInt16    = 0xd1
+	mpInt32    = 0xd2
+	mpInt64    = 0xd3
+	mpFixExt1  = 0xd4
+	mpFixExt16 = 0xd8
+	mpStr8     = 0xd9
+	mpStr16    = 0xda
+	mpStr32    = 0xdb
+	mpArray16  = 0xdc
+	mpArray32  = 0xdd
+	mpMap16    = 0xde
+	mpMap32    = 0xdf
+)
+
+// maxLength bounds the length of strings, binaries, arrays and maps
+// accepted by the decoder, to protect against corrupted input.
+const maxLength = 64 << 20
+
+// maxPrealloc bounds the elements or bytes allocated ahead of decoding
+// them, so that a length in the input does not by itself allocate
+// maxLength worth of memory.  Longer values grow as they decode.
+const maxPrealloc = 1 << 12
+
+// maxDepth bounds the nesting of arrays and maps accepted by the decoder,
+// which would otherwise overflow the stack.
+const maxDepth = 10000
+
+var errTooDeep = errors.New("msgpack: nesting too deep")
+
+// Marshal returns the MessagePack encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := NewEncoder(w).Encode(v); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the MessagePack value in data into v, which must be a
+// non-nil pointer.
+func Unmarshal(data []byte, v interface{}) error {
+	return NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// An Encoder writes MessagePack values to a buffered stream.
+type Encoder struct {
+	w   *bufio.Writer
+	buf [9]byte
+}
+
+// NewEncoder returns an encoder writing to w.  The caller is responsible
+// for flushing w.
+func NewEncoder(w *bufio.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the MessagePack encoding of v.
+func (e *Encoder) Encode(v interface{}) error {
+	return e.encode(reflect.ValueOf(v))
+}
+
+func (e *Encoder) writeByte(b byte) error {
+	return e.w.WriteByte(b)
+}
+
+// writeHead writes a format byte followed by n in size bytes.
+func (e *Encoder) writeHead(format byte, n uint64, size int) error {
+	e.buf[0] = format
+	switch size {
+	case 1:
+		e.buf[1] = byte(n)
+	case 2:
+		binary.BigEndian.PutUint16(e.buf[1:], uint16(n))
+	case 4:
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(n))
+	case 8:
+		binary.BigEndian.PutUint64(e.buf[1:], n)
+	}
+	_, err := e.w.Write(e.buf[:1+size])
+	return err
+}
+
+// writeLength writes the header of a string, bin, array or map.  fix is
+// the fix format base, or 0 if the type has none, fixMax the largest
+// length it can hold, and f8, f16, f32 the sized formats.
+func (e *Encoder) writeLength(n int, fix byte, fixMax int, f8, f16, f32 byte) error {
+	switch {
+	case fix != 0 && n <= fixMax:
+		return e.writeByte(fix | byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		return e.writeHead(f8, uint64(n), 1)
+	case n <= math.MaxUint16:
+		return e.writeHead(f16, uint64(n), 2)
+	case uint64(n) <= math.MaxUint32:
+		return e.writeHead(f32, uint64(n), 4)
+	}
+	return errors.New("msgpack: value too long")
+}
+
+func (e *Encoder) encodeInt(i int64) error {
+	switch {
+	case i >= 0:
+		return e.encodeUint(uint64(i))
+	case i >= -32:
+		return e.writeByte(byte(i))
+	case i >= math.MinInt8:
+		return e.writeHead(mpInt8, uint64(i), 1)
+	case i >= math.MinInt16:
+		return e.writeHead(mpInt16, uint64(i), 2)
+	case i >= math.MinInt32:
+		return e.writeHead(mpInt32, uint64(i), 4)
+	}
+	return e.writeHead(mpInt64, uint64(i), 8)
+}
+
+func (e *Encoder) encodeUint(u uint64) error {
+	switch {
+	case u <= 0x7f:
+		return e.writeByte(byte(u))
+	case u <= math.MaxUint8:
+		return e.writeHead(mpUint8, u, 1)
+	case u <= math.MaxUint16:
+		return e.writeHead(mpUint16, u, 2)
+	case u <= math.MaxUint32:
+		return e.writeHead(mpUint32, u, 4)
+	}
+	return e.writeHead(mpUint64, u, 8)
+}
+
+func (e *Encoder) encodeString(s string) error {
+	if err := e.writeLength(len(s), 0xa0, 31, mpStr8, mpStr16, mpStr32); err != nil {
+		return err
+	}
+	_, err := e.w.WriteString(s)
+	return err
+}
+
+func (e *Encoder) encodeBytes(b []byte) error {
+	if err := e.writeLength(len(b), 0, 0, mpBin8, mpBin16, mpBin32); err != nil {
+		return err
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *Encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		return e.writeByte(mpNil)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return e.writeByte(mpTrue)
+		}
+		return e.writeByte(mpFalse)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return e.encodeUint(v.Uint())
+	case reflect.Float32:
+		return e.writeHead(mpFloat32, uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		return e.writeHead(mpFloat64, math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		return e.encodeString(v.String())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return e.writeByte(mpNil)
+		}
+		return e.encode(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return e.writeByte(mpNil)
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.encodeBytes(v.Bytes())
+		}
+		fallthrough
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return e.encodeBytes(b)
+		}
+		n := v.Len()
+		if err := e.writeLength(n, 0x90, 15, 0, mpArray16, mpArray32); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if v.IsNil() {
+			return e.writeByte(mpNil)
+		}
+		if err := e.writeLength(v.Len(), 0x80, 15, 0, mpMap16, mpMap32); err != nil {
+			return err
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		if err := e.writeLength(len(fields), 0x80, 15, 0, mpMap16, mpMap32); err != nil {
+			return err
+		}
+		for _, f := range fields {
+			if err := e.encodeString(f.name); err != nil {
+				return err
+			}
+			fv, err := v.FieldByIndexErr(f.index)
+			if err != nil {
+				// Promoted through a nil embedded pointer.
+				fv = reflect.Value{}
+			}
+			if err := e.encode(fv); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("msgpack: unsupported type %v", v.Type())
+}
+
+type field struct {
+	name  string
+	index []int
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the encoded fields of struct type t, including the
+// ones promoted from embedded structs.
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var fields []field
+	for _, sf := range reflect.VisibleFields(t) {
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct && sf.Tag.Get("msgpack") == "" {
+			continue // its fields are listed on their own
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		name := sf.Name
+		if tag := sf.Tag.Get("msgpack"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			name = strings.Split(tag, ",")[0]
+		}
+		fields = append(fields, field{name, sf.Index})
+	}
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.([]field)
+}
+
+// A Decoder reads MessagePack values from a buffered stream.
+type Decoder struct {
+	r     *bufio.Reader
+	buf   [8]byte
+	depth int // of the array or map being decoded
+}
+
+// NewDecoder returns a decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Decode reads the next value into v, which must be a non-nil pointer, or
+// nil to skip the value.
+func (d *Decoder) Decode(v interface{}) error {
+	d.depth = 0
+	if v == nil {
+		return d.skip()
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: Decode of non-pointer %T", v)
+	}
+	return d.decode(rv.Elem())
+}
+
+func (d *Decoder) readN(n int) ([]byte, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return d.buf[:n], nil
+}
+
+func (d *Decoder) readUint(size int) (uint64, error) {
+	b, err := d.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *Decoder) readLength(size int) (int, error) {
+	n, err := d.readUint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > maxLength {
+		return 0, errors.New("msgpack: length too large")
+	}
+	return int(n), nil
+}
+
+func (d *Decoder) readBytes(n int) ([]byte, error) {
+	if n > maxPrealloc {
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// enter starts decoding an array or map, failing if it is nested too
+// deep.  leave must be called once it is decoded.
+func (d *Decoder) enter() error {
+	if d.depth >= maxDepth {
+		return errTooDeep
+	}
+	d.depth++
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// prealloc returns the capacity to allocate for n elements.
+func prealloc(n int) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return n
+}
+
+// value is a decoded scalar, or the header of a container.
+type value struct {
+	kind byte // one of the k* constants
+	i    int64
+	u    uint64
+	f    float64
+	b    []byte // str or bin contents
+	n    int    // number of elements of an array or entries of a map
+}
+
+const (
+	kNil = iota
+	kBool
+	kInt
+	kUint
+	kFloat
+	kStr
+	kBin
+	kArray
+	kMap
+	kExt
+)
+
+// next reads the next format byte and the data it announces, except for
+// the elements of arrays and maps.
+func (d *Decoder) next() (val value, err error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return
+	}
+	switch {
+	case c <= 0x7f:
+		return value{kind: kUint, u: uint64(c)}, nil
+	case c >= 0xe0:
+		return value{kind: kInt, i: int64(int8(c))}, nil
+	case c&0xf0 == 0x80:
+		return value{kind: kMap, n: int(c & 0x0f)}, nil
+	case c&0xf0 == 0x90:
+		return value{kind: kArray, n: int(c & 0x0f)}, nil
+	case c&0xe0 == 0xa0:
+		val.kind = kStr
+		val.b, err = d.readBytes(int(c & 0x1f))
+		return
+	}
+	var u uint64
+	switch c {
+	case mpNil:
+		return value{kind: kNil}, nil
+	case mpFalse:
+		return value{kind: kBool}, nil
+	case mpTrue:
+		return value{kind: kBool, u: 1}, nil
+	case mpBin8, mpBin16, mpBin32:
+		val.kind = kBin
+		if val.n, err = d.readLength(1 << (c - mpBin8)); err != nil {
+			return
+		}
+		val.b, err = d.readBytes(val.n)
+		return
+	case mpStr8, mpStr16, mpStr32:
+		val.kind = kStr
+		if val.n, err = d.readLength(1 << (c - mpStr8)); err != nil {
+			return
+		}
+		val.b, err = d.readBytes(val.n)
+		return
+	case mpFloat32:
+		u, err = d.readUint(4)
+		return value{kind: kFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case mpFloat64:
+		u, err = d.readUint(8)
+		return value{kind: kFloat, f: math.Float64frombits(u)}, err
+	case mpUint8, mpUint16, mpUint32, mpUint64:
+		u, err = d.readUint(1 << (c - mpUint8))
+		return value{kind: kUint, u: u}, err
+	case mpInt8:
+		u, err = d.readUint(1)
+		return value{kind: kInt, i: int64(int8(u))}, err
+	case mpInt16:
+		u, err = d.readUint(2)
+		return value{kind: kInt, i: int64(int16(u))}, err
+	case mpInt32:
+		u, err = d.readUint(4)
+		return value{kind: kInt, i: int64(int32(u))}, err
+	case mpInt64:
+		u, err = d.readUint(8)
+		return value{kind: kInt, i: int64(u)}, err
+	case mpArray16, mpArray32:
+		val.kind = kArray
+		val.n, err = d.readLength(2 << (c - mpArray16))
+		return
+	case mpMap16, mpMap32:
+		val.kind = kMap
+		val.n, err = d.readLength(2 << (c - mpMap16))
+		return
+	case mpExt8, mpExt16, mpExt32:
+		var n int
+		if n, err = d.readLength(1 << (c - mpExt8)); err != nil {
+			return
+		}
+		val.kind = kExt
+		val.b, err = d.readBytes(n + 1) // type byte and data
+		return
+	}
+	if c >= mpFixExt1 && c <= mpFixExt16 {
+		val.kind = kExt
+		val.b, err = d.readBytes(1<<(c-mpFixExt1) + 1)
+		return
+	}
+	return val, fmt.Errorf("msgpack: invalid format byte %#x", c)
+}
+
+// skip reads and discards the next value.
+func (d *Decoder) skip() error {
+	val, err := d.next()
+	if err != nil {
+		return err
+	}
+	n := val.n
+	switch val.kind {
+	case kArray:
+	case kMap:
+		n *= 2
+	default:
+		return nil
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	for i := 0; i < n; i++ {
+		if err := d.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) decode(v reflect.Value) error {
+	val, err := d.next()
+	if err != nil {
+		return err
+	}
+	return d.decodeValue(val, v)
+}
+
+func (d *Decoder) decodeValue(val value, v reflect.Value) error {
+	if val.kind == kNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(val, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			break
+		}
+		x, err := d.decodeInterface(val)
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			v.Set(reflect.ValueOf(x))
+		} else {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+
+	switch val.kind {
+	case kBool:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(val.u != 0)
+			return nil
+		}
+	case kInt, kUint, kFloat:
+		return setNumber(val, v)
+	case kStr, kBin:
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(val.b))
+			return nil
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(val.b)
+			return nil
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			reflect.Copy(v, reflect.ValueOf(val.b))
+			return nil
+		}
+	case kArray:
+		return d.decodeArray(val.n, v)
+	case kMap:
+		return d.decodeMap(val.n, v)
+	case kExt:
+		return fmt.Errorf("msgpack: cannot decode extension type %d", int8(val.b[0]))
+	}
+	return fmt.Errorf("msgpack: cannot decode %s into %v", kindNames[val.kind], v.Type())
+}
+
+var kindNames = []string{"nil", "bool", "int", "uint", "float", "str", "bin", "array", "map", "ext"}
+
+func setNumber(val value, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch val.kind {
+		case kInt:
+			i = val.i
+		case kUint:
+			if val.u > math.MaxInt64 {
+				return fmt.Errorf("msgpack: %d overflows %v", val.u, v.Type())
+			}
+			i = int64(val.u)
+		default:
+			return fmt.Errorf("msgpack: cannot decode float into %v", v.Type())
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %d overflows %v", i, v.Type())
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch val.kind {
+		case kUint:
+			u = val.u
+		case kInt:
+			if val.i < 0 {
+				return fmt.Errorf("msgpack: %d overflows %v", val.i, v.Type())
+			}
+			u = uint64(val.i)
+		default:
+			return fmt.Errorf("msgpack: cannot decode float into %v", v.Type())
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %v", u, v.Type())
+		}
+		v.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch val.kind {
+		case kInt:
+			v.SetFloat(float64(val.i))
+		case kUint:
+			v.SetFloat(float64(val.u))
+		default:
+			v.SetFloat(val.f)
+		}
+		return nil
+	}
+	return fmt.Errorf("msgpack: cannot decode number into %v", v.Type())
+}
+
+func (d *Decoder) decodeArray(n int, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Cap() >= n {
+			v.SetLen(n)
+		} else {
+			v.Set(reflect.MakeSlice(v.Type(), 0, prealloc(n)))
+		}
+	case reflect.Array:
+		if n > v.Len() {
+			return fmt.Errorf("msgpack: array of %d elements overflows %v", n, v.Type())
+		}
+		for i := n; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	default:
+		for i := 0; i < n; i++ {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("msgpack: cannot decode array into %v", v.Type())
+	}
+	for i := 0; i < n; i++ {
+		if i == v.Len() {
+			// A slice grown as elements decode.
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		}
+		if err := d.decode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) decodeMap(n int, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	switch v.Kind() {
+	case reflect.Map:
+		t := v.Type()
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(t, prealloc(n)))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(t.Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			elem := reflect.New(t.Elem()).Elem()
+			if err := d.decode(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+		return nil
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		for i := 0; i < n; i++ {
+			var name string
+			if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			var f *field
+			for j := range fields {
+				if fields[j].name == name {
+					f = &fields[j]
+					break
+				}
+			}
+			if f == nil {
+				// Unknown field, as sent by a newer peer.
+				if err := d.skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(fieldByIndex(v, f.index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < 2*n; i++ {
+		if err := d.skip(); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("msgpack: cannot decode map into %v", v.Type())
+}
+
+// fieldByIndex is like v.FieldByIndex but allocates nil embedded pointers.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func (d *Decoder) decodeInterface(val value) (interface{}, error) {
+	switch val.kind {
+	case kNil:
+		return nil, nil
+	case kBool:
+		return val.u != 0, nil
+	case kInt:
+		return val.i, nil
+	case kUint:
+		return val.u, nil
+	case kFloat:
+		return val.f, nil
+	case kStr:
+		return string(val.b), nil
+	case kBin:
+		return val.b, nil
+	case kArray:
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+		a := make([]interface{}, 0, prealloc(val.n))
+		for i := 0; i < val.n; i++ {
+			elem, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			x, err := d.decodeInterface(elem)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, x)
+		}
+		return a, nil
+	case kMap:
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+		m := make(map[interface{}]interface{}, prealloc(val.n))
+		for i := 0; i < val.n; i++ {
+			kv, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			k, err := d.decodeInterface(kv)
+			if err != nil {
+				return nil, err
+			}
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, errors.New("msgpack: unhashable map key")
+			}
+			ev, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			if m[k], err = d.decodeInterface(ev); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("msgpack: cannot decode extension type %d", int8(val.b[0]))
+}
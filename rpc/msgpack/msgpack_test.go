@@ -0,0 +1,293 @@
+package msgpack
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	rpc "github.com/lijie/go/rpc"
+)
+
+type Inner struct {
+	Tags []string
+}
+
+type Item struct {
+	ID      uint32 `msgpack:"id"`
+	Name    string
+	Score   float64
+	Delta   int16
+	Data    []byte
+	Attrs   map[string]int
+	Skipped int `msgpack:"-"`
+	Inner
+	Next *Item
+}
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, "\xc0"},
+		{true, "\xc3"},
+		{5, "\x05"},
+		{-3, "\xfd"},
+		{200, "\xcc\xc8"},
+		{-200, "\xd1\xff\x38"},
+		{uint32(70000), "\xce\x00\x01\x11\x70"},
+		{"hi", "\xa2hi"},
+		{[]byte{1, 2}, "\xc4\x02\x01\x02"},
+		{[]int{1, 2}, "\x92\x01\x02"},
+		{map[string]bool{"a": false}, "\x81\xa1a\xc2"},
+		{1.5, "\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		b, err := Marshal(tt.v)
+		if err != nil {
+			t.Fatal(tt.v, err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("Marshal(%#v) = % x, want % x", tt.v, b, tt.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := Item{
+		ID:      7,
+		Name:    "sword",
+		Score:   math.Pi,
+		Delta:   -1234,
+		Data:    []byte("raw"),
+		Attrs:   map[string]int{"atk": 10, "def": -2},
+		Skipped: 99,
+		Inner:   Inner{Tags: []string{"rare"}},
+		Next:    &Item{ID: 8, Name: "shield"},
+	}
+	b, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Item
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Skipped = 0
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip:\n got %+v\nwant %+v", out, in)
+	}
+
+	var generic interface{}
+	if err := Unmarshal(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	m := generic.(map[interface{}]interface{})
+	if m["id"] != uint64(7) || m["Name"] != "sword" || m["Delta"] != int64(-1234) {
+		t.Fatal("generic decode:", m)
+	}
+
+	var small int8
+	if err := Unmarshal([]byte("\xcc\xc8"), &small); err == nil {
+		t.Fatal("decoding 200 into int8 should overflow")
+	}
+}
+
+func add(ctx context.Context, arg *Item, reply *Item) error {
+	if arg.ID == 0 {
+		return rpc.Error(3)
+	}
+	*reply = *arg
+	reply.ID++
+	return nil
+}
+
+func TestClientServer(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(1, add); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(context.Background(), NewServerCodec(srv))
+	c := NewClient(cli)
+	defer c.Close()
+
+	var reply Item
+	if err := c.Call(1, &Item{ID: 1, Name: "x"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ID != 2 || reply.Name != "x" {
+		t.Fatal("reply:", reply)
+	}
+	if err := c.Call(1, &Item{}, &reply); err != rpc.Error(3) {
+		t.Fatal("failing call returned", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := rpc.NewServer()
+	items := func(ctx context.Context, n int, stream *rpc.ServerStream) error {
+		for i := 0; i < n; i++ {
+			if err := stream.Send(&Item{ID: uint32(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := server.RegisterStream(1, items); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(context.Background(), NewServerCodec(srv))
+	c := NewClient(cli)
+	defer c.Close()
+
+	s, err := c.StreamWithWindow(context.Background(), 1, 10, Item{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		v, err := s.Recv()
+		if err != nil {
+			t.Fatal("Recv", i, err)
+		}
+		if v.(*Item).ID != uint32(i) {
+			t.Fatal("element", i, "is", v)
+		}
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Fatal("end of stream returned", err)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(1, func(ctx context.Context, arg *Item, reply *Item) error {
+		return &rpc.StatusError{Code: 3, Message: "no item", Details: map[string]string{"name": arg.Name}}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(context.Background(), NewServerCodec(srv))
+	c := NewClient(cli)
+	defer c.Close()
+
+	var reply Item
+	err := c.Call(1, &Item{Name: "x"}, &reply)
+	status, ok := err.(*rpc.StatusError)
+	if !ok || status.Code != 3 || status.Message != "no item" || status.Details["name"] != "x" {
+		t.Fatalf("call returned %#v", err)
+	}
+	// The connection is still in sync.
+	if err := c.Call(1, &Item{Name: "y"}, &reply); err == nil {
+		t.Fatal("second call succeeded")
+	}
+}
+
+func TestUnencodableBody(t *testing.T) {
+	type Wave struct {
+		Phase complex128
+	}
+	server := rpc.NewServer()
+	if err := server.Register(1, add); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(2, func(ctx context.Context, arg *Item, reply *Wave) error {
+		reply.Phase = 1i
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(context.Background(), NewServerCodec(srv))
+	c := NewClient(cli)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wave Wave
+	if err := c.CallContext(ctx, 2, &Item{}, &wave); err != rpc.ErrInternal {
+		t.Fatal("unencodable reply returned", err)
+	}
+	if err := c.CallContext(ctx, 1, &Wave{Phase: 1i}, &Item{}); err == nil {
+		t.Fatal("unencodable arg succeeded")
+	}
+	// Neither failure left a partial frame on the connection.
+	var reply Item
+	if err := c.CallContext(ctx, 1, &Item{ID: 1}, &reply); err != nil || reply.ID != 2 {
+		t.Fatal("next call returned", reply, err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(1, func(ctx context.Context, arg *Item, reply *Item) error {
+		rpc.SetReplyMetadata(ctx, "seen", rpc.IncomingMetadata(ctx)["user"])
+		*reply = *arg
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(context.Background(), NewServerCodec(srv))
+	c := NewClient(cli)
+	defer c.Close()
+
+	ctx := rpc.WithMetadata(context.Background(), rpc.Metadata{"user": "bob"})
+	var reply Item
+	call := <-c.GoContext(ctx, 1, &Item{ID: 1}, &reply, make(chan *rpc.Call, 1)).Done
+	if call.Error != nil || reply.ID != 1 {
+		t.Fatal("call:", reply, call.Error)
+	}
+	if call.ReplyMetadata["seen"] != "bob" {
+		t.Fatal("reply metadata", call.ReplyMetadata)
+	}
+}
+
+func TestDeepNesting(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0x91}, 1<<20), 0xc0)
+	var x interface{}
+	if err := Unmarshal(data, &x); err != errTooDeep {
+		t.Errorf("decoding into interface{}: %v, want %v", err, errTooDeep)
+	}
+	var a []interface{}
+	if err := Unmarshal(data, &a); err != errTooDeep {
+		t.Errorf("decoding into []interface{}: %v, want %v", err, errTooDeep)
+	}
+	if err := Unmarshal(data, nil); err != errTooDeep {
+		t.Errorf("skipping: %v, want %v", err, errTooDeep)
+	}
+	// Nesting within the limit still decodes.
+	data = append(bytes.Repeat([]byte{0x91}, 100), 0xc0)
+	if err := Unmarshal(data, &x); err != nil {
+		t.Errorf("decoding 100 nested arrays: %v", err)
+	}
+}
+
+// TestHugeCount checks that lengths announced by the input are not
+// allocated before the elements arrive.
+func TestHugeCount(t *testing.T) {
+	for _, data := range [][]byte{
+		{0xdd, 0x03, 0xff, 0xff, 0xff, 0x01}, // array32
+		{0xdf, 0x03, 0xff, 0xff, 0xff, 0x01}, // map32
+		{0xdb, 0x03, 0xff, 0xff, 0xff, 'x'},  // str32
+	} {
+		for _, v := range []interface{}{new(interface{}), new([]int), new(map[int]int), new(string)} {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			if err := Unmarshal(data, v); err == nil {
+				t.Errorf("decoding % x into %T succeeded", data, v)
+			}
+			runtime.ReadMemStats(&after)
+			if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+				t.Errorf("decoding % x into %T allocated %d bytes", data, v, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package msgpack
+
+import (
+	"io"
+	"net"
+
+	rpc "github.com/lijie/go/rpc"
+)
+
+type serverCodec struct {
+	c   io.ReadWriteCloser
+	dec *Decoder
+	out *frameWriter
+
+	// temporary work space
+	hdr [7]uint32
+}
+
+// NewServerCodec returns a new rpc.ServerCodec using MessagePack on conn.
+func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &serverCodec{
+		c:   conn,
+		dec: NewDecoder(conn),
+		out: newFrameWriter(conn),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.readHeader(c.hdr[:], &r.Metadata); err != nil {
+		return err
+	}
+	r.Cmd = c.hdr[0]
+	r.Seq = c.hdr[1]
+	r.Kind = uint8(c.hdr[2])
+	r.Timeout = c.hdr[3]
+	r.Window = c.hdr[4]
+	r.Error = c.hdr[5]
+	r.Version = c.hdr[6]
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(x interface{}) error {
+	return c.dec.Decode(x)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	var errorBody uint32
+	switch {
+	case r.ErrorBody:
+		errorBody = 1
+	case r.Error != 0:
+		x = nil
+	}
+	err := c.out.encode([]uint32{r.Cmd, r.Seq, r.Error, uint32(r.Kind), r.Window, errorBody, r.Version}, r.Metadata, x)
+	if err != nil {
+		// Nothing has been written, so the call can fail on its own
+		// without breaking the connection.
+		if c.out.encode([]uint32{r.Cmd, r.Seq, uint32(rpc.ErrInternal), uint32(r.Kind), r.Window, 0, r.Version}, nil, nil) != nil {
+			c.Close()
+			return err
+		}
+		if ferr := c.out.flush(); ferr != nil {
+			return ferr
+		}
+		return err
+	}
+	return c.out.flush()
+}
+
+// RemoteAddr returns the peer address if the codec serves a net.Conn.
+func (c *serverCodec) RemoteAddr() net.Addr {
+	if conn, ok := c.c.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *serverCodec) Close() error {
+	return c.c.Close()
+}
+
+// ServeConn runs the MessagePack server on a single connection.
+// ServeConn blocks, serving the connection until the client hangs up.
+// The caller typically invokes ServeConn in a go statement.
+func ServeConn(conn io.ReadWriteCloser) {
+	rpc.ServeCodec(NewServerCodec(conn))
+}
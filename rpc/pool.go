@@ -0,0 +1,408 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balance is the way a Pool picks the server of each call.
+type Balance int
+
+const (
+	// RoundRobin sends the calls to each server in turn.
+	RoundRobin Balance = iota
+	// LeastOutstanding sends each call to the connection with the fewest
+	// calls in flight.
+	LeastOutstanding
+	// ConsistentHash sends the calls with the same key, set with
+	// WithHashKey, to the same server as long as it is healthy.  Calls
+	// without a key are sent round-robin.
+	ConsistentHash
+)
+
+// PoolOptions configure a Pool.  The zero value is usable.
+type PoolOptions struct {
+	ConnsPerAddr int     // connections to each address, 1 if 0
+	Balance      Balance // how calls are spread over the addresses
+	// Dial connects to addr; it dials TCP and uses the gob codec if nil.
+	// Calls routed to a connection being dialed wait for Dial, so it
+	// should give up after a while.
+	Dial        func(addr string) (*Client, error)
+	DialTimeout time.Duration // bound of the default Dial, 10s if 0
+	// An address failing EjectAfter times in a row, 3 if 0, is left out
+	// for EjectFor, 10s if 0.  Only failures to dial and connections
+	// lost during calls count; errors returned by handlers don't.
+	EjectAfter int
+	EjectFor   time.Duration
+	Replicas   int // points of each address on the hash ring, 100 if 0
+}
+
+// A Pool spreads calls over connections to several servers assumed to
+// serve the same cmds.  Connections are dialed when first needed and
+// redialed once lost.  A call is sent once: if dialing fails it is tried
+// on another address, but it is never resent after a connection is lost.
+type Pool struct {
+	opts      PoolOptions
+	endpoints []*endpoint
+	ring      []ringPoint // sorted by hash
+	next      uint32      // accessed atomically, for RoundRobin
+
+	mu     sync.Mutex // protects following
+	closed bool
+}
+
+type endpoint struct {
+	index int // in Pool.endpoints
+	addr  string
+	conns []*poolConn
+	next  uint32 // accessed atomically
+
+	mu           sync.Mutex // protects following
+	failures     int
+	ejectedUntil time.Time
+}
+
+type poolConn struct {
+	outstanding int64 // accessed atomically
+
+	mu      sync.Mutex // protects following
+	client  *Client
+	dialing chan struct{} // closed once the dial in progress is over
+}
+
+type ringPoint struct {
+	hash     uint32
+	endpoint int
+}
+
+// errSharedDial is returned to the callers that waited for the dial of
+// another one, when it fails.
+var errSharedDial = errors.New("rpc: dial failed")
+
+type hashKey struct{}
+
+// WithHashKey returns a copy of ctx carrying the key that a Pool using
+// ConsistentHash routes the call on.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// NewPool returns a pool of connections to addrs.  opts may be nil.
+func NewPool(addrs []string, opts *PoolOptions) *Pool {
+	p := &Pool{}
+	if opts != nil {
+		p.opts = *opts
+	}
+	if p.opts.ConnsPerAddr <= 0 {
+		p.opts.ConnsPerAddr = 1
+	}
+	if p.opts.DialTimeout <= 0 {
+		p.opts.DialTimeout = 10 * time.Second
+	}
+	if p.opts.Dial == nil {
+		timeout := p.opts.DialTimeout
+		p.opts.Dial = func(addr string) (*Client, error) {
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err != nil {
+				return nil, err
+			}
+			return NewClient(conn), nil
+		}
+	}
+	if p.opts.EjectAfter <= 0 {
+		p.opts.EjectAfter = 3
+	}
+	if p.opts.EjectFor <= 0 {
+		p.opts.EjectFor = 10 * time.Second
+	}
+	if p.opts.Replicas <= 0 {
+		p.opts.Replicas = 100
+	}
+	for i, addr := range addrs {
+		e := &endpoint{index: i, addr: addr, conns: make([]*poolConn, p.opts.ConnsPerAddr)}
+		for j := range e.conns {
+			e.conns[j] = new(poolConn)
+		}
+		p.endpoints = append(p.endpoints, e)
+		for j := 0; j < p.opts.Replicas; j++ {
+			h := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(j)))
+			p.ring = append(p.ring, ringPoint{h, i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	return p
+}
+
+// healthy reports whether e may take calls at now.
+func (e *endpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.ejectedUntil)
+}
+
+// report records the outcome of using e, ejecting it after too many
+// failures in a row.
+func (e *endpoint) report(ok bool, opts *PoolOptions) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ok {
+		e.failures = 0
+		return
+	}
+	e.failures++
+	if e.failures >= opts.EjectAfter {
+		e.failures = 0
+		e.ejectedUntil = time.Now().Add(opts.EjectFor)
+	}
+}
+
+func (e *endpoint) outstanding() int64 {
+	var n int64
+	for _, pc := range e.conns {
+		n += atomic.LoadInt64(&pc.outstanding)
+	}
+	return n
+}
+
+// pick returns the connection of e to use next.
+func (e *endpoint) pick(balance Balance) *poolConn {
+	start := int(atomic.AddUint32(&e.next, 1))
+	best := e.conns[start%len(e.conns)]
+	if balance == LeastOutstanding {
+		for i := 1; i < len(e.conns); i++ {
+			pc := e.conns[(start+i)%len(e.conns)]
+			if atomic.LoadInt64(&pc.outstanding) < atomic.LoadInt64(&best.outstanding) {
+				best = pc
+			}
+		}
+	}
+	return best
+}
+
+// pickEndpoint returns the endpoint to send a call bounded by ctx to,
+// skipping those already tried, or nil if no healthy one is left.
+func (p *Pool) pickEndpoint(ctx context.Context, tried []bool) *endpoint {
+	now := time.Now()
+	usable := func(i int) bool {
+		return !tried[i] && p.endpoints[i].healthy(now)
+	}
+	n := len(p.endpoints)
+	if p.opts.Balance == ConsistentHash && ctx != nil {
+		if key, ok := ctx.Value(hashKey{}).(string); ok && len(p.ring) > 0 {
+			h := crc32.ChecksumIEEE([]byte(key))
+			i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+			for j := 0; j < len(p.ring); j++ {
+				pt := p.ring[(i+j)%len(p.ring)]
+				if usable(pt.endpoint) {
+					return p.endpoints[pt.endpoint]
+				}
+			}
+			return nil
+		}
+	}
+	start := int(atomic.AddUint32(&p.next, 1))
+	var best *endpoint
+	var bestLoad int64
+	for j := 0; j < n; j++ {
+		i := (start + j) % n
+		if !usable(i) {
+			continue
+		}
+		e := p.endpoints[i]
+		if p.opts.Balance != LeastOutstanding {
+			return e
+		}
+		if load := e.outstanding(); best == nil || load < bestLoad {
+			best, bestLoad = e, load
+		}
+	}
+	return best
+}
+
+// client returns the client of pc, dialing addr if it has none or has
+// lost its connection.  Concurrent callers share the dial, waiting for it
+// until ctx is done.  pc.mu is not held while dialing, so that Close is
+// not held up by an address that does not answer.
+func (p *Pool) client(ctx context.Context, pc *poolConn, addr string) (*Client, error) {
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	pc.mu.Lock()
+	for {
+		if pc.client != nil {
+			select {
+			case <-pc.client.dead:
+				pc.client = nil
+			default:
+				client := pc.client
+				pc.mu.Unlock()
+				return client, nil
+			}
+		}
+		if pc.dialing == nil {
+			break
+		}
+		dialing := pc.dialing
+		pc.mu.Unlock()
+		select {
+		case <-dialing:
+		case <-done:
+			return nil, context.Cause(ctx)
+		}
+		pc.mu.Lock()
+		if pc.client == nil && pc.dialing == nil {
+			// The dial failed; let the caller try another address
+			// rather than dial again.
+			pc.mu.Unlock()
+			return nil, errSharedDial
+		}
+	}
+	dialing := make(chan struct{})
+	pc.dialing = dialing
+	pc.mu.Unlock()
+
+	client, err := p.opts.Dial(addr)
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.dialing = nil
+	close(dialing)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		client.Close()
+		return nil, ErrShutdown
+	}
+	pc.client = client
+	return client, nil
+}
+
+// lostConnection reports whether err means the connection of a call
+// failed, rather than the call itself.
+func lostConnection(err error) bool {
+	switch err {
+	case nil, ErrTimeout, context.Canceled, context.DeadlineExceeded:
+		return false
+	case ErrShutdown, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	var code Error
+	var serverErr ServerError
+	return !errors.As(err, &code) && !errors.As(err, &serverErr)
+}
+
+// Go invokes the function asynchronously on one of the servers, as with
+// Client.Go.
+func (p *Pool) Go(cmd uint32, args interface{}, reply interface{}, done chan *Call) *Call {
+	return p.GoContext(nil, cmd, args, reply, done)
+}
+
+// GoContext is like Go but the call is bounded by ctx, as with
+// Client.GoContext.  ctx also carries the key of ConsistentHash.
+func (p *Pool) GoContext(ctx context.Context, cmd uint32, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := newCall(cmd, args, reply, done)
+	go p.send(ctx, call)
+	return call
+}
+
+// send picks a connection for call, sends it and completes it once the
+// reply is in.
+func (p *Pool) send(ctx context.Context, call *Call) {
+	call.Error = ErrUnavailable
+	tried := make([]bool, len(p.endpoints))
+	for {
+		p.mu.Lock()
+		closed := p.closed
+		p.mu.Unlock()
+		if closed {
+			call.Error = ErrShutdown
+			break
+		}
+		e := p.pickEndpoint(ctx, tried)
+		if e == nil {
+			break
+		}
+		pc := e.pick(p.opts.Balance)
+		client, err := p.client(ctx, pc, e.addr)
+		if err != nil {
+			call.Error = err
+			if ctx != nil && ctx.Err() != nil {
+				break
+			}
+			// Nothing was sent; try another address.  The failure
+			// of a shared dial is reported by the caller who dialed.
+			if err != errSharedDial {
+				e.report(false, &p.opts)
+			} else {
+				call.Error = ErrUnavailable
+			}
+			tried[e.index] = true
+			continue
+		}
+		atomic.AddInt64(&pc.outstanding, 1)
+		attempt := <-client.GoContext(ctx, call.Cmd, call.Args, call.Reply, make(chan *Call, 1)).Done
+		atomic.AddInt64(&pc.outstanding, -1)
+		e.report(!lostConnection(attempt.Error), &p.opts)
+		call.Seq = attempt.Seq
+		call.ReplyMetadata = attempt.ReplyMetadata
+		call.Error = attempt.Error
+		break
+	}
+	call.done()
+}
+
+// Call invokes the named function on one of the servers, waits for it to
+// complete, and returns its error status.
+func (p *Pool) Call(cmd uint32, args interface{}, reply interface{}) error {
+	call := <-p.Go(cmd, args, reply, make(chan *Call, 1)).Done
+	return call.Error
+}
+
+// CallContext is like Call but the call is bounded by ctx.
+func (p *Pool) CallContext(ctx context.Context, cmd uint32, args interface{}, reply interface{}) error {
+	call := <-p.GoContext(ctx, cmd, args, reply, make(chan *Call, 1)).Done
+	return call.Error
+}
+
+// CallWithTimeout is like Call but fails with ErrTimeout if the reply
+// does not arrive within d.
+func (p *Pool) CallWithTimeout(cmd uint32, args interface{}, reply interface{}, d time.Duration) error {
+	ctx, cancel := context.WithTimeoutCause(context.Background(), d, ErrTimeout)
+	defer cancel()
+	return p.CallContext(ctx, cmd, args, reply)
+}
+
+// Close closes all the connections of the pool.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrShutdown
+	}
+	p.closed = true
+	p.mu.Unlock()
+	for _, e := range p.endpoints {
+		for _, pc := range e.conns {
+			pc.mu.Lock()
+			if pc.client != nil {
+				pc.client.Close()
+				pc.client = nil
+			}
+			pc.mu.Unlock()
+		}
+	}
+	return nil
+}
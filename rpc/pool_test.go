@@ -0,0 +1,229 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// poolServers serves a server per address over pipes; the handler of cmd
+// 1 replies the index of its server, and that of cmd 2 blocks until
+// release is closed.
+type poolServers struct {
+	servers map[string]*Server
+	release chan struct{}
+
+	mu    sync.Mutex
+	dials map[string]int
+}
+
+func newPoolServers(t *testing.T, addrs ...string) *poolServers {
+	ps := &poolServers{
+		servers: make(map[string]*Server),
+		release: make(chan struct{}),
+		dials:   make(map[string]int),
+	}
+	for i, addr := range addrs {
+		i := i
+		server := NewServer()
+		whoami := func(ctx context.Context, arg int, reply *int) error {
+			*reply = i
+			return nil
+		}
+		block := func(ctx context.Context, arg int, reply *int) error {
+			<-ps.release
+			*reply = i
+			return nil
+		}
+		if err := server.Register(1, whoami); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Register(2, block); err != nil {
+			t.Fatal(err)
+		}
+		ps.servers[addr] = server
+	}
+	return ps
+}
+
+func (ps *poolServers) dial(addr string) (*Client, error) {
+	ps.mu.Lock()
+	ps.dials[addr]++
+	ps.mu.Unlock()
+	server := ps.servers[addr]
+	if server == nil {
+		return nil, errors.New("connection refused")
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	return NewClient(cli), nil
+}
+
+func (ps *poolServers) dialed(addr string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.dials[addr]
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	ps := newPoolServers(t, "a", "b", "c")
+	p := NewPool([]string{"a", "b", "c"}, &PoolOptions{ConnsPerAddr: 2, Dial: ps.dial})
+	defer p.Close()
+
+	hits := make([]int, 3)
+	for i := 0; i < 30; i++ {
+		var who int
+		if err := p.Call(1, 0, &who); err != nil {
+			t.Fatal(err)
+		}
+		hits[who]++
+	}
+	for i, n := range hits {
+		if n != 10 {
+			t.Fatal("server", i, "got", n, "of 30 calls")
+		}
+	}
+	for _, addr := range []string{"a", "b", "c"} {
+		if n := ps.dialed(addr); n != 2 {
+			t.Fatal(addr, "dialed", n, "times")
+		}
+	}
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	ps := newPoolServers(t, "a", "b", "c")
+	p := NewPool([]string{"a", "b", "c"}, &PoolOptions{Balance: ConsistentHash, Dial: ps.dial})
+	defer p.Close()
+
+	owner := make(map[string]int)
+	used := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		for k := 0; k < 50; k++ {
+			key := "user" + strconv.Itoa(k)
+			var who int
+			if err := p.CallContext(WithHashKey(context.Background(), key), 1, 0, &who); err != nil {
+				t.Fatal(err)
+			}
+			if prev, ok := owner[key]; ok && prev != who {
+				t.Fatal(key, "moved from", prev, "to", who)
+			}
+			owner[key] = who
+			used[who] = true
+		}
+	}
+	if len(used) != 3 {
+		t.Fatal("keys spread over", len(used), "servers")
+	}
+}
+
+func TestPoolLeastOutstanding(t *testing.T) {
+	ps := newPoolServers(t, "a", "b")
+	p := NewPool([]string{"a", "b"}, &PoolOptions{Balance: LeastOutstanding, Dial: ps.dial})
+	defer p.Close()
+
+	// A call blocks on one server; the following ones go to the other.
+	var blocked int
+	call := p.Go(2, 0, &blocked, nil)
+	time.Sleep(20 * time.Millisecond)
+	var first int
+	for i := 0; i < 5; i++ {
+		var who int
+		if err := p.Call(1, 0, &who); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = who
+		} else if who != first {
+			t.Fatal("call", i, "went to the busy server")
+		}
+	}
+	close(ps.release)
+	<-call.Done
+	if call.Error != nil || blocked == first {
+		t.Fatal("blocked call:", call.Error, blocked, first)
+	}
+}
+
+func TestPoolEject(t *testing.T) {
+	ps := newPoolServers(t, "a", "b")
+	p := NewPool([]string{"a", "dead", "b"}, &PoolOptions{Dial: ps.dial, EjectAfter: 2, EjectFor: time.Hour})
+	defer p.Close()
+
+	var failed int32
+	for i := 0; i < 20; i++ {
+		var who int
+		if err := p.Call(1, 0, &who); err != nil {
+			atomic.AddInt32(&failed, 1)
+		}
+	}
+	if failed != 0 {
+		t.Fatal(failed, "calls failed with a healthy server left")
+	}
+	if n := ps.dialed("dead"); n != 2 {
+		t.Fatal("dead address dialed", n, "times")
+	}
+
+	p.Close()
+	var who int
+	if err := p.Call(1, 0, &who); err != ErrShutdown {
+		t.Fatal("call on a closed pool returned", err)
+	}
+}
+
+// TestPoolSlowDial checks that a dial that does not return holds up
+// neither Close nor the calls that give up waiting for it.
+func TestPoolSlowDial(t *testing.T) {
+	ps := newPoolServers(t, "a")
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	dialed := make(chan *Client, 1)
+	dial := func(addr string) (*Client, error) {
+		close(entered)
+		<-unblock
+		client, err := ps.dial("a")
+		dialed <- client
+		return client, err
+	}
+	p := NewPool([]string{"blackhole"}, &PoolOptions{Dial: dial})
+
+	first := make(chan error, 1)
+	go func() {
+		var reply int
+		first <- p.Call(1, 0, &reply)
+	}()
+	<-entered
+
+	// A call waiting for the same dial gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var reply int
+	if err := p.CallContext(ctx, 1, 0, &reply); err != context.DeadlineExceeded {
+		t.Fatalf("call waiting for the dial returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- p.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal("Close:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close waited for the dial")
+	}
+
+	close(unblock)
+	if err := <-first; err != ErrShutdown {
+		t.Fatalf("call dialing during Close returned %v, want %v", err, ErrShutdown)
+	}
+	select {
+	case <-(<-dialed).dead:
+	case <-time.After(time.Second):
+		t.Fatal("client dialed after Close was kept open")
+	}
+}
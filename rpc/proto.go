@@ -0,0 +1,471 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+)
+
+// ProtoMessage is implemented by protocol buffer messages generated with
+// Marshal and Unmarshal methods, such as those of gogo/protobuf.
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+var typeOfProtoMessage = reflect.TypeOf((*ProtoMessage)(nil)).Elem()
+
+// maxProtoFrame bounds the size of a header or body read by the proto codec.
+const maxProtoFrame = 64 << 20
+
+// checkProtoType reports whether values of type t, or pointers to them,
+// are proto messages.
+func checkProtoType(t reflect.Type) error {
+	if t.Kind() != reflect.Ptr {
+		t = reflect.PtrTo(t)
+	}
+	if !t.Implements(typeOfProtoMessage) {
+		return fmt.Errorf("rpc: %v is not a proto message", t)
+	}
+	return nil
+}
+
+// NewProtoServer returns a new Server whose Register only accepts
+// handlers taking and replying proto messages, as required to serve them
+// with ServeProtoConn.
+func NewProtoServer() *Server {
+	server := NewServer()
+	server.SetTypeCheck(checkProtoType)
+	return server
+}
+
+// The proto wire format is a stream of frames, each made of a header and a
+// body.  Both are preceded by their length as a varint, as in the
+// delimited protobuf streams most libraries can read and write.  The
+// header is itself a protobuf message:
+//
+//	message Request {
+//		uint32 cmd = 1;
+//		uint32 seq = 2;
+//		uint32 kind = 3;
+//		uint32 timeout = 4;
+//		uint32 window = 5;
+//		uint32 error = 6;
+//		uint32 version = 7;
+//		map<string, string> metadata = 8;
+//	}
+//
+//	message Response {
+//		uint32 cmd = 1;
+//		uint32 seq = 2;
+//		uint32 error = 3;
+//		uint32 kind = 4;
+//		uint32 window = 5;
+//		bool error_body = 6;
+//		uint32 version = 7;
+//		map<string, string> metadata = 8;
+//	}
+//
+// The body is the serialized argument or reply, and is empty for control
+// frames and for error responses without error_body.  With error_body,
+// it is a StatusError:
+//
+//	message StatusError {
+//		string message = 1;
+//		map<string, string> details = 2;
+//	}
+type protoCodec struct {
+	rwc  io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+	rhdr []byte // header of the last frame read
+	body []byte // body of the last frame read
+	whdr []byte
+}
+
+func newProtoCodec(conn io.ReadWriteCloser) *protoCodec {
+	return &protoCodec{rwc: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+func (c *protoCodec) readDelimited(buf []byte) ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxProtoFrame {
+		return nil, errors.New("rpc: proto frame too large")
+	}
+	if uint64(cap(buf)) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err = io.ReadFull(c.r, buf); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+// readFrame reads the next header into fields, indexed by field number,
+// and the metadata into md, and keeps the body for readBody.
+func (c *protoCodec) readFrame(fields []uint32, md *Metadata) error {
+	var err error
+	if c.rhdr, err = c.readDelimited(c.rhdr); err != nil {
+		return err
+	}
+	for i := range fields {
+		fields[i] = 0
+	}
+	if err = decodeProtoHeader(c.rhdr, fields); err != nil {
+		return err
+	}
+	*md = nil
+	if err = readProtoMap(c.rhdr, 8, (*map[string]string)(md)); err != nil {
+		return err
+	}
+	c.body, err = c.readDelimited(c.body)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *protoCodec) readBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	m, ok := x.(ProtoMessage)
+	if !ok {
+		return fmt.Errorf("rpc: %T is not a proto message", x)
+	}
+	return m.Unmarshal(c.body)
+}
+
+// marshalProto encodes the body of a frame.
+func marshalProto(x interface{}) ([]byte, error) {
+	switch m := x.(type) {
+	case nil:
+		return nil, nil
+	case ProtoMessage:
+		return m.Marshal()
+	}
+	// invalidRequest stands for the empty body of control frames.
+	if x != invalidRequest {
+		return nil, fmt.Errorf("rpc: %T is not a proto message", x)
+	}
+	return nil, nil
+}
+
+func (c *protoCodec) writeFrame(fields []uint32, md Metadata, x interface{}) error {
+	body, err := marshalProto(x)
+	if err != nil {
+		return err
+	}
+	return c.write(fields, md, body)
+}
+
+// write writes a frame made of a header and an encoded body.
+func (c *protoCodec) write(fields []uint32, md Metadata, body []byte) error {
+	hdr := c.whdr[:0]
+	for i, v := range fields {
+		if v != 0 {
+			hdr = binary.AppendUvarint(hdr, uint64(i)<<3) // varint wire type
+			hdr = binary.AppendUvarint(hdr, uint64(v))
+		}
+	}
+	hdr = appendProtoMap(hdr, 8, md)
+	c.whdr = hdr
+	var n [binary.MaxVarintLen64]byte
+	c.w.Write(n[:binary.PutUvarint(n[:], uint64(len(hdr)))])
+	c.w.Write(hdr)
+	c.w.Write(n[:binary.PutUvarint(n[:], uint64(len(body)))])
+	c.w.Write(body)
+	return c.w.Flush()
+}
+
+// decodeProtoHeader stores the varint fields of a header message in
+// fields, skipping unknown ones so that newer peers may add fields.
+func decodeProtoHeader(b []byte, fields []uint32) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("rpc: malformed proto header")
+		}
+		b = b[n:]
+		num, typ := tag>>3, tag&7
+		switch typ {
+		case 0: // varint
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("rpc: malformed proto header")
+			}
+			b = b[n:]
+			if num < uint64(len(fields)) {
+				fields[num] = uint32(v)
+			}
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return errors.New("rpc: malformed proto header")
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("rpc: malformed proto header")
+			}
+			b = b[n+int(l):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return errors.New("rpc: malformed proto header")
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("rpc: unsupported proto wire type %d", typ)
+		}
+	}
+	return nil
+}
+
+// protoStatus is the proto encoding of a StatusError.
+type protoStatus StatusError
+
+func (s *protoStatus) Marshal() ([]byte, error) {
+	var b []byte
+	if s.Message != "" {
+		b = appendProtoString(b, 1, s.Message)
+	}
+	return appendProtoMap(b, 2, s.Details), nil
+}
+
+func (s *protoStatus) Unmarshal(b []byte) error {
+	err := readProtoStrings(b, func(num uint64, v []byte) error {
+		if num == 1 {
+			s.Message = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return readProtoMap(b, 2, &s.Details)
+}
+
+func appendProtoString(b []byte, num uint64, s string) []byte {
+	b = binary.AppendUvarint(b, num<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendProtoMap appends m as the map<string, string> field num.
+func appendProtoMap(b []byte, num uint64, m map[string]string) []byte {
+	var entry []byte
+	for k, v := range m {
+		entry = appendProtoString(appendProtoString(entry[:0], 1, k), 2, v)
+		b = binary.AppendUvarint(b, num<<3|2)
+		b = binary.AppendUvarint(b, uint64(len(entry)))
+		b = append(b, entry...)
+	}
+	return b
+}
+
+// readProtoMap adds the entries of the map<string, string> field num of
+// the message b to *m.
+func readProtoMap(b []byte, num uint64, m *map[string]string) error {
+	return readProtoStrings(b, func(n uint64, v []byte) error {
+		if n != num {
+			return nil
+		}
+		var key, val string
+		err := readProtoStrings(v, func(n uint64, v []byte) error {
+			switch n {
+			case 1:
+				key = string(v)
+			case 2:
+				val = string(v)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if *m == nil {
+			*m = make(map[string]string)
+		}
+		(*m)[key] = val
+		return nil
+	})
+}
+
+// readProtoStrings calls f with the length-delimited fields of the
+// message b, skipping the others.
+func readProtoStrings(b []byte, f func(num uint64, v []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("rpc: malformed proto message")
+		}
+		b = b[n:]
+		var skip int
+		switch tag & 7 {
+		case 0:
+			if _, skip = binary.Uvarint(b); skip <= 0 {
+				return errors.New("rpc: malformed proto message")
+			}
+		case 1:
+			skip = 8
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("rpc: malformed proto message")
+			}
+			if err := f(tag>>3, b[n:n+int(l)]); err != nil {
+				return err
+			}
+			skip = n + int(l)
+		case 5:
+			skip = 4
+		default:
+			return fmt.Errorf("rpc: unsupported proto wire type %d", tag&7)
+		}
+		if len(b) < skip {
+			return errors.New("rpc: malformed proto message")
+		}
+		b = b[skip:]
+	}
+	return nil
+}
+
+type protoServerCodec struct {
+	*protoCodec
+	fields [8]uint32
+}
+
+// NewProtoServerCodec returns a ServerCodec reading and writing proto
+// message bodies on conn.
+func NewProtoServerCodec(conn io.ReadWriteCloser) ServerCodec {
+	return &protoServerCodec{protoCodec: newProtoCodec(conn)}
+}
+
+func (c *protoServerCodec) ReadRequestHeader(r *Request) error {
+	if err := c.readFrame(c.fields[:], &r.Metadata); err != nil {
+		return err
+	}
+	r.Cmd = c.fields[1]
+	r.Seq = c.fields[2]
+	r.Kind = uint8(c.fields[3])
+	r.Timeout = c.fields[4]
+	r.Window = c.fields[5]
+	r.Error = c.fields[6]
+	r.Version = c.fields[7]
+	return nil
+}
+
+func (c *protoServerCodec) ReadRequestBody(x interface{}) error {
+	return c.readBody(x)
+}
+
+func (c *protoServerCodec) WriteResponse(r *Response, x interface{}) error {
+	fields := [8]uint32{1: r.Cmd, 2: r.Seq, 3: r.Error, 4: uint32(r.Kind), 5: r.Window, 7: r.Version}
+	switch {
+	case r.ErrorBody:
+		fields[6] = 1
+		x = (*protoStatus)(x.(*StatusError))
+	case r.Error != 0:
+		x = nil
+	}
+	body, err := marshalProto(x)
+	if err != nil {
+		// Fail the call rather than leave the client waiting for a reply.
+		fields[3], fields[6] = uint32(ErrInternal), 0
+		if werr := c.write(fields[:], r.Metadata, nil); werr != nil {
+			return werr
+		}
+		return err
+	}
+	return c.write(fields[:], r.Metadata, body)
+}
+
+func (c *protoServerCodec) RemoteAddr() net.Addr {
+	if conn, ok := c.rwc.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *protoServerCodec) Close() error {
+	return c.rwc.Close()
+}
+
+type protoClientCodec struct {
+	*protoCodec
+	fields [8]uint32
+}
+
+// NewProtoClientCodec returns a ClientCodec reading and writing proto
+// message bodies on conn.
+func NewProtoClientCodec(conn io.ReadWriteCloser) ClientCodec {
+	return &protoClientCodec{protoCodec: newProtoCodec(conn)}
+}
+
+func (c *protoClientCodec) WriteRequest(r *Request, x interface{}) error {
+	fields := [8]uint32{1: r.Cmd, 2: r.Seq, 3: uint32(r.Kind), 4: r.Timeout, 5: r.Window, 6: r.Error, 7: r.Version}
+	return c.writeFrame(fields[:], r.Metadata, x)
+}
+
+func (c *protoClientCodec) ReadResponseHeader(r *Response) error {
+	if err := c.readFrame(c.fields[:], &r.Metadata); err != nil {
+		return err
+	}
+	r.Cmd = c.fields[1]
+	r.Seq = c.fields[2]
+	r.Error = c.fields[3]
+	r.Kind = uint8(c.fields[4])
+	r.Window = c.fields[5]
+	r.ErrorBody = c.fields[6] != 0
+	r.Version = c.fields[7]
+	return nil
+}
+
+func (c *protoClientCodec) ReadResponseBody(x interface{}) error {
+	if status, ok := x.(*StatusError); ok {
+		x = (*protoStatus)(status)
+	}
+	return c.readBody(x)
+}
+
+func (c *protoClientCodec) RemoteAddr() net.Addr {
+	if conn, ok := c.rwc.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *protoClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// ServeProtoConn is like ServeConn but uses proto message bodies.  The
+// server should have been created with NewProtoServer so that only proto
+// message handlers can be registered.
+func (server *Server) ServeProtoConn(ctx context.Context, conn io.ReadWriteCloser) {
+	server.ServeCodec(ctx, NewProtoServerCodec(conn))
+}
+
+// NewProtoClient is like NewClient but uses proto message bodies.
+func NewProtoClient(conn io.ReadWriteCloser) *Client {
+	return NewClientWithCodec(NewProtoClientCodec(conn))
+}
+
+// DialProto connects to an RPC server using proto message bodies at the
+// specified network address.
+func DialProto(network, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewProtoClient(conn), nil
+}
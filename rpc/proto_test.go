@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pair stands for a generated message with two uint32 fields:
+//
+//	message Pair {
+//		uint32 a = 1;
+//		uint32 b = 2;
+//	}
+type Pair struct {
+	A, B uint32
+}
+
+func (p *Pair) Marshal() ([]byte, error) {
+	var b []byte
+	b = binary.AppendUvarint(b, 1<<3)
+	b = binary.AppendUvarint(b, uint64(p.A))
+	b = binary.AppendUvarint(b, 2<<3)
+	b = binary.AppendUvarint(b, uint64(p.B))
+	return b, nil
+}
+
+func (p *Pair) Unmarshal(b []byte) error {
+	fields := make([]uint32, 3)
+	if err := decodeProtoHeader(b, fields); err != nil {
+		return errors.New("bad pair")
+	}
+	p.A, p.B = fields[1], fields[2]
+	return nil
+}
+
+func swap(ctx context.Context, arg *Pair, reply *Pair) error {
+	if arg.A == 0 {
+		return Error(9)
+	}
+	reply.A, reply.B = arg.B, arg.A
+	return nil
+}
+
+// BrokenPair is a message failing to marshal.
+type BrokenPair struct {
+	Pair
+}
+
+func (p *BrokenPair) Marshal() ([]byte, error) {
+	return nil, errors.New("broken pair")
+}
+
+func TestProtoCodec(t *testing.T) {
+	server := NewProtoServer()
+	if err := server.Register(1, swap); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(2, Add); err == nil {
+		t.Fatal("proto server accepted a non-proto handler")
+	}
+	if err := server.Register(3, func(ctx context.Context, arg *Pair, reply *BrokenPair) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeProtoConn(context.Background(), srv)
+	c := NewProtoClient(cli)
+	defer c.Close()
+
+	var reply Pair
+	if err := c.Call(1, &Pair{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != (Pair{2, 1}) {
+		t.Fatal("swap got", reply)
+	}
+	if err := c.Call(1, &Pair{0, 2}, &reply); err != Error(9) {
+		t.Fatal("failing call returned", err)
+	}
+	if err := c.Call(2, &Pair{1, 2}, &reply); err == nil {
+		t.Fatal("call to unregistered cmd succeeded")
+	}
+	// A body that is not a proto message is not sent as an empty one.
+	if err := c.Call(1, &AddParams{1, 2}, &reply); err == nil || !strings.Contains(err.Error(), "not a proto message") {
+		t.Fatal("call with a non-proto argument returned", err)
+	}
+	if err := c.Call(1, &Pair{3, 4}, &reply); err != nil || reply != (Pair{4, 3}) {
+		t.Fatal("call after a non-proto argument:", reply, err)
+	}
+	// A reply that fails to marshal fails its call alone.
+	if err := c.CallWithTimeout(3, &Pair{1, 2}, &BrokenPair{}, 5*time.Second); err != ErrInternal {
+		t.Fatal("call with a broken reply returned", err)
+	}
+	if err := c.Call(1, &Pair{5, 6}, &reply); err != nil || reply != (Pair{6, 5}) {
+		t.Fatal("call after a broken reply:", reply, err)
+	}
+}
@@ -0,0 +1,384 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnavailable is returned for the calls a ReconnectingClient cannot
+// send because it is not connected, or has too many calls queued.
+var ErrUnavailable = errors.New("rpc: not connected")
+
+// ConnState is the state of the connection of a ReconnectingClient.
+type ConnState int
+
+const (
+	StateConnecting   ConnState = iota // dialing
+	StateConnected                     // calls are sent right away
+	StateDisconnected                  // waiting before dialing again
+	StateClosed                        // Close has been called
+)
+
+var stateNames = [...]string{"connecting", "connected", "disconnected", "closed"}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+// OutagePolicy tells a ReconnectingClient what to do with the calls made
+// while it is not connected.
+type OutagePolicy int
+
+const (
+	// FailFast fails the calls with ErrUnavailable.
+	FailFast OutagePolicy = iota
+	// QueueCalls holds the calls until the connection is back, or
+	// their context is done.
+	QueueCalls
+)
+
+// ReconnectOptions configure a ReconnectingClient.  The zero value is
+// usable: it fails calls during outages and backs off from 100ms up to
+// 30s with a 20% jitter.  The delay grows with each failed dial and each
+// connection dropped before it served a call or stayed up for
+// MaxBackoff.
+type ReconnectOptions struct {
+	MinBackoff time.Duration // delay before the first redial, 100ms if 0
+	MaxBackoff time.Duration // bound of the delay, 30s if 0
+	Multiplier float64       // growth of the delay after each failure, 2 if 0
+	Jitter     float64       // the delay varies randomly by up to this fraction, 0.2 if 0
+	Policy     OutagePolicy
+	MaxQueued  int // bound of the calls queued under QueueCalls, 0 for no limit
+}
+
+// A ReconnectingClient is a Client that dials again whenever its
+// connection drops.  Calls made while the connection is up behave as
+// with Client; calls in flight when it drops fail as they would with
+// Client, and are not retried.  Notification handlers and interceptors
+// are installed on every new connection.
+type ReconnectingClient struct {
+	dial func() (*Client, error)
+	opts ReconnectOptions
+
+	closing chan struct{} // closed by Close
+
+	mu           sync.Mutex // protects following
+	client       *Client    // nil while not connected
+	ready        chan struct{}
+	state        ConnState
+	queued       int
+	closed       bool
+	ntf          map[uint32]*notifier
+	interceptors []ClientInterceptor
+	watchers     []func(ConnState)
+}
+
+// NewReconnectingClient returns a client that connects with dial, right
+// away and after every disconnection.  opts may be nil.
+func NewReconnectingClient(dial func() (*Client, error), opts *ReconnectOptions) *ReconnectingClient {
+	rc := &ReconnectingClient{
+		dial:    dial,
+		closing: make(chan struct{}),
+		ready:   make(chan struct{}),
+		ntf:     make(map[uint32]*notifier),
+	}
+	if opts != nil {
+		rc.opts = *opts
+	}
+	if rc.opts.MinBackoff <= 0 {
+		rc.opts.MinBackoff = 100 * time.Millisecond
+	}
+	if rc.opts.MaxBackoff <= 0 {
+		rc.opts.MaxBackoff = 30 * time.Second
+	}
+	if rc.opts.Multiplier < 1 {
+		rc.opts.Multiplier = 2
+	}
+	if rc.opts.Jitter <= 0 {
+		rc.opts.Jitter = 0.2
+	}
+	go rc.run()
+	return rc
+}
+
+// DialReconnecting returns a ReconnectingClient connecting to the RPC
+// server at the specified network address.
+func DialReconnecting(network, address string, opts *ReconnectOptions) *ReconnectingClient {
+	return NewReconnectingClient(func() (*Client, error) {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(conn), nil
+	}, opts)
+}
+
+// run dials, waits for the connection to drop and dials again until the
+// client is closed.
+func (rc *ReconnectingClient) run() {
+	defer rc.setState(StateClosed)
+	failures := 0
+	for {
+		rc.setState(StateConnecting)
+		client, err := rc.dial()
+		if err != nil {
+			rc.setState(StateDisconnected)
+			if !rc.sleep(rc.backoff(failures)) {
+				return
+			}
+			failures++
+			continue
+		}
+
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			client.Close()
+			return
+		}
+		client.mutex.Lock()
+		for cmd, n := range rc.ntf {
+			client.ntf[cmd] = n
+		}
+		client.interceptors = rc.interceptors
+		client.mutex.Unlock()
+		rc.client = client
+		close(rc.ready)
+		rc.mu.Unlock()
+		rc.setState(StateConnected)
+
+		up := time.Now()
+		select {
+		case <-client.dead:
+		case <-rc.closing:
+			client.Close()
+			return
+		}
+		rc.mu.Lock()
+		rc.client = nil
+		rc.ready = make(chan struct{})
+		rc.mu.Unlock()
+		rc.setState(StateDisconnected)
+		// A server that accepts connections and drops them right away
+		// must not be redialed in a tight loop, so only a connection
+		// that served a call or stayed up for MaxBackoff resets the
+		// backoff.
+		if atomic.LoadInt32(&client.replied) != 0 || time.Since(up) >= rc.opts.MaxBackoff {
+			failures = 0
+		}
+		if !rc.sleep(rc.backoff(failures)) {
+			return
+		}
+		failures++
+	}
+}
+
+// backoff returns the delay before the next dial after failures failed
+// attempts in a row.
+func (rc *ReconnectingClient) backoff(failures int) time.Duration {
+	d := float64(rc.opts.MinBackoff)
+	for i := 0; i < failures && d < float64(rc.opts.MaxBackoff); i++ {
+		d *= rc.opts.Multiplier
+	}
+	if d > float64(rc.opts.MaxBackoff) {
+		d = float64(rc.opts.MaxBackoff)
+	}
+	d *= 1 + rc.opts.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// sleep waits for d, reporting false if the client is closed meanwhile.
+func (rc *ReconnectingClient) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-rc.closing:
+		return false
+	}
+}
+
+func (rc *ReconnectingClient) setState(s ConnState) {
+	rc.mu.Lock()
+	if rc.state == s {
+		rc.mu.Unlock()
+		return
+	}
+	rc.state = s
+	watchers := rc.watchers
+	rc.mu.Unlock()
+	for _, f := range watchers {
+		f(s)
+	}
+}
+
+// State returns the current state of the connection.
+func (rc *ReconnectingClient) State() ConnState {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.state
+}
+
+// OnStateChange registers f to be called with every new state of the
+// connection.  f runs on the goroutine managing the connection, so it
+// must not block.
+func (rc *ReconnectingClient) OnStateChange(f func(ConnState)) {
+	rc.mu.Lock()
+	rc.watchers = append(rc.watchers[:len(rc.watchers):len(rc.watchers)], f)
+	rc.mu.Unlock()
+}
+
+// OnNotify registers handler as with Client.OnNotify, on the current
+// connection and all the following ones.
+func (rc *ReconnectingClient) OnNotify(cmd uint32, body interface{}, handler NotifyHandler) {
+	rc.mu.Lock()
+	if handler == nil {
+		delete(rc.ntf, cmd)
+	} else {
+		rc.ntf[cmd] = &notifier{typ: notifyType(body), handler: handler}
+	}
+	client := rc.client
+	rc.mu.Unlock()
+	if client != nil {
+		client.OnNotify(cmd, body, handler)
+	}
+}
+
+// Use appends interceptors as with Client.Use, on the current connection
+// and all the following ones.
+func (rc *ReconnectingClient) Use(interceptors ...ClientInterceptor) {
+	rc.mu.Lock()
+	rc.interceptors = append(rc.interceptors[:len(rc.interceptors):len(rc.interceptors)], interceptors...)
+	client := rc.client
+	rc.mu.Unlock()
+	if client != nil {
+		client.Use(interceptors...)
+	}
+}
+
+// current returns the connected client, or, if there is none, a channel
+// closed once there is one.
+func (rc *ReconnectingClient) current() (*Client, chan struct{}, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return nil, nil, ErrShutdown
+	}
+	if rc.client != nil {
+		return rc.client, nil, nil
+	}
+	if rc.opts.Policy != QueueCalls || (rc.opts.MaxQueued > 0 && rc.queued >= rc.opts.MaxQueued) {
+		return nil, nil, ErrUnavailable
+	}
+	rc.queued++
+	return nil, rc.ready, nil
+}
+
+// wait waits for ready to be closed and returns the client then
+// connected.
+func (rc *ReconnectingClient) wait(ctx context.Context, ready chan struct{}) (*Client, error) {
+	defer func() {
+		rc.mu.Lock()
+		rc.queued--
+		rc.mu.Unlock()
+	}()
+	for {
+		var done <-chan struct{}
+		if ctx != nil {
+			done = ctx.Done()
+		}
+		select {
+		case <-ready:
+		case <-done:
+			return nil, context.Cause(ctx)
+		case <-rc.closing:
+			return nil, ErrShutdown
+		}
+		rc.mu.Lock()
+		client := rc.client
+		ready = rc.ready
+		rc.mu.Unlock()
+		if client != nil {
+			return client, nil
+		}
+		// The connection dropped again before we got to it.
+	}
+}
+
+// Go invokes the function asynchronously, as with Client.Go.
+func (rc *ReconnectingClient) Go(cmd uint32, args interface{}, reply interface{}, done chan *Call) *Call {
+	return rc.GoContext(nil, cmd, args, reply, done)
+}
+
+// GoContext is like Go but the call is bounded by ctx, as with
+// Client.GoContext.  Under QueueCalls, ctx also bounds the wait for the
+// connection.
+func (rc *ReconnectingClient) GoContext(ctx context.Context, cmd uint32, args interface{}, reply interface{}, done chan *Call) *Call {
+	client, ready, err := rc.current()
+	if client != nil {
+		return client.GoContext(ctx, cmd, args, reply, done)
+	}
+	call := newCall(cmd, args, reply, done)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+	go func() {
+		client, err := rc.wait(ctx, ready)
+		if err == nil {
+			attempt := <-client.GoContext(ctx, cmd, args, reply, make(chan *Call, 1)).Done
+			call.Seq = attempt.Seq
+			call.ReplyMetadata = attempt.ReplyMetadata
+			err = attempt.Error
+		}
+		call.Error = err
+		call.done()
+	}()
+	return call
+}
+
+// Call invokes the named function, waits for it to complete, and returns
+// its error status.
+func (rc *ReconnectingClient) Call(cmd uint32, args interface{}, reply interface{}) error {
+	call := <-rc.Go(cmd, args, reply, make(chan *Call, 1)).Done
+	return call.Error
+}
+
+// CallContext is like Call but the call is bounded by ctx.
+func (rc *ReconnectingClient) CallContext(ctx context.Context, cmd uint32, args interface{}, reply interface{}) error {
+	call := <-rc.GoContext(ctx, cmd, args, reply, make(chan *Call, 1)).Done
+	return call.Error
+}
+
+// CallWithTimeout is like Call but fails with ErrTimeout if the call does
+// not complete within d, including the time spent waiting for the
+// connection.
+func (rc *ReconnectingClient) CallWithTimeout(cmd uint32, args interface{}, reply interface{}, d time.Duration) error {
+	ctx, cancel := context.WithTimeoutCause(context.Background(), d, ErrTimeout)
+	defer cancel()
+	return rc.CallContext(ctx, cmd, args, reply)
+}
+
+// Close closes the current connection and stops redialing.  Queued calls
+// fail with ErrShutdown.
+func (rc *ReconnectingClient) Close() error {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return ErrShutdown
+	}
+	rc.closed = true
+	rc.mu.Unlock()
+	close(rc.closing)
+	return nil
+}
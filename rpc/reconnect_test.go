@@ -0,0 +1,183 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDialer dials server over pipes, failing while down is set.
+type pipeDialer struct {
+	server *Server
+
+	mu    sync.Mutex
+	down  bool
+	dials int
+	conn  net.Conn // server side of the last connection
+}
+
+func (d *pipeDialer) dial() (*Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.down {
+		return nil, errors.New("server down")
+	}
+	cli, srv := net.Pipe()
+	d.conn = srv
+	go d.server.ServeConn(context.Background(), srv)
+	return NewClient(cli), nil
+}
+
+// drop closes the current connection and keeps the server down until up
+// is called.
+func (d *pipeDialer) drop() {
+	d.mu.Lock()
+	d.down = true
+	d.conn.Close()
+	d.mu.Unlock()
+}
+
+func (d *pipeDialer) up() {
+	d.mu.Lock()
+	d.down = false
+	d.mu.Unlock()
+}
+
+func TestReconnectingClient(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(103, AddNotify); err != nil {
+		t.Fatal(err)
+	}
+	d := &pipeDialer{server: server}
+	states := make(chan ConnState, 100)
+	rc := NewReconnectingClient(d.dial, &ReconnectOptions{MinBackoff: 10 * time.Millisecond, Policy: QueueCalls})
+	rc.OnStateChange(func(s ConnState) { states <- s })
+	defer rc.Close()
+	notified := make(chan int, 10)
+	rc.OnNotify(200, Sum{}, func(cmd uint32, body interface{}) {
+		notified <- body.(*Sum).Total
+	})
+
+	call := func(a, b int) {
+		t.Helper()
+		reply := 0
+		if err := rc.CallWithTimeout(103, &AddParams{a, b}, &reply, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if reply != a+b {
+			t.Fatal("reply:", reply)
+		}
+		select {
+		case total := <-notified:
+			if total != a+b {
+				t.Fatal("notify total:", total)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("notification not delivered")
+		}
+	}
+	call(1, 2)
+
+	// Calls made during the outage wait for the connection to be back.
+	d.drop()
+	waitState(t, states, StateDisconnected)
+	done := make(chan struct{})
+	go func() {
+		call(3, 4)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("call completed while disconnected")
+	default:
+	}
+	d.up()
+	waitState(t, states, StateConnected)
+	<-done
+
+	// Queued calls are bounded by their context.
+	d.drop()
+	waitState(t, states, StateDisconnected)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	reply := 0
+	if err := rc.CallContext(ctx, 103, &AddParams{1, 1}, &reply); err != context.DeadlineExceeded {
+		t.Fatal("queued call returned", err)
+	}
+
+	rc.Close()
+	waitState(t, states, StateClosed)
+	if err := rc.Call(103, &AddParams{1, 1}, &reply); err != ErrShutdown {
+		t.Fatal("call after Close returned", err)
+	}
+}
+
+func TestReconnectingClientFailFast(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	d := &pipeDialer{server: server, down: true}
+	rc := NewReconnectingClient(d.dial, &ReconnectOptions{MinBackoff: 5 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	defer rc.Close()
+
+	reply := 0
+	if err := rc.Call(100, &AddParams{1, 2}, &reply); err != ErrUnavailable {
+		t.Fatal("call while down returned", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	d.mu.Lock()
+	dials := d.dials
+	d.mu.Unlock()
+	// Backing off from 5ms to 20ms makes at most a dozen dials in 100ms.
+	if dials < 3 || dials > 12 {
+		t.Fatal("dialed", dials, "times in 100ms")
+	}
+	if s := rc.State(); s == StateConnected {
+		t.Fatal("state is", s)
+	}
+}
+
+func waitState(t *testing.T, states chan ConnState, want ConnState) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case s := <-states:
+			if s == want {
+				return
+			}
+		case <-timeout:
+			t.Fatal("state never became", want)
+		}
+	}
+}
+
+// TestReconnectBackoffAfterDrop checks that a server dropping connections
+// right after accepting them is redialed with backoff.
+func TestReconnectBackoffAfterDrop(t *testing.T) {
+	var mu sync.Mutex
+	dials := 0
+	dial := func() (*Client, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		cli, srv := net.Pipe()
+		srv.Close()
+		return NewClient(cli), nil
+	}
+	rc := NewReconnectingClient(dial, &ReconnectOptions{MinBackoff: 10 * time.Millisecond, MaxBackoff: time.Second})
+	time.Sleep(300 * time.Millisecond)
+	rc.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	// 10ms, 20ms, 40ms... allow for the jitter and a slow machine.
+	if dials < 2 || dials > 10 {
+		t.Fatalf("%d dials in 300ms", dials)
+	}
+}
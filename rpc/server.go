@@ -3,14 +3,19 @@ package rpc
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -18,6 +23,8 @@ import (
 var debugLog = false
 
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+var typeOfConn = reflect.TypeOf((*Conn)(nil))
 
 const (
 	// Defaults used by HandleHTTP
@@ -25,6 +32,8 @@ const (
 	DefaultDebugPath = "/debug/rpc"
 )
 
+// JsonRequest is a call received by the HTTP JSON gateway, see
+// Server.JSONHandler.  Params holds the JSON encoding of the argument.
 type JsonRequest struct {
 	Cmd    uint32           `json:"cmd"`
 	Seq    uint32           `json:"seq"`
@@ -37,6 +46,8 @@ func (r *JsonRequest) reset() {
 	r.Params = nil
 }
 
+// JsonResponse is the answer of the HTTP JSON gateway to a JsonRequest.
+// Error is empty on success.
 type JsonResponse struct {
 	Cmd    uint32      `json:"cmd"`
 	Seq    uint32      `json:"seq"`
@@ -48,44 +59,109 @@ type JsonResponse struct {
 // but documented here as an aid to debugging, such as when analyzing
 // network traffic.
 type Request struct {
-	Cmd  uint32
-	Seq  uint32   // sequence number chosen by client
-	next *Request // for free list in Server
-}
+	Cmd      uint32
+	Seq      uint32   // sequence number chosen by client
+	Kind     uint8    // kind of frame, KindCall for a plain call
+	Timeout  uint32   // milliseconds the client waits for the reply, 0 for no limit
+	Window   uint32   // stream frames the client is ready to receive, 0 for no limit
+	Error    uint32   // error code of a KindStreamReset frame
+	Version  uint32   // protocol version offered by a KindHello frame
+	Metadata Metadata // sent with the call if the protocol version is at least 1
+	next     *Request // for free list in Server
+}
+
+// Kinds of frames, carried in Request.Kind and Response.Kind.  Peers that
+// predate a kind see every frame as a call or a reply, so codecs that
+// cannot carry Kind must drop the frames other than KindCall.
+const (
+	// KindCall is a call, answered by a Response of the same kind.
+	KindCall uint8 = iota
+	// KindCancel cancels the call or stream with the same Seq.
+	KindCancel
+	// KindStream opens a server stream, answered by KindStreamData
+	// responses and a final KindStreamEnd.
+	KindStream
+	// KindWindow lets the peer send Window more frames on the stream
+	// with the same Seq.
+	KindWindow
+	// KindStreamData carries an element of a stream.
+	KindStreamData
+	// KindStreamEnd ends the frames sent by one side of a stream.  A
+	// server stream ends with Error if it failed.
+	KindStreamEnd
+	// KindDuplex opens a duplex stream, on which both sides send
+	// KindStreamData frames until they send KindStreamEnd.  The server
+	// answers with a KindWindow response granting its receive window.
+	KindDuplex
+	// KindStreamReset aborts a duplex stream in both directions with the
+	// code in Error.  The server also sends it, with Error 0 if the
+	// handler succeeded, when the handler returns.
+	KindStreamReset
+	// KindPing asks the peer for a KindPong, to tell that the connection
+	// is alive.  Both sides send it, the server as a Response with Seq 0.
+	KindPing
+	// KindPong answers a KindPing.
+	KindPong
+	// KindHello precedes the first call carrying metadata: the client
+	// offers the highest protocol version it speaks in Version and the
+	// server answers with the version both will speak.  The hello takes
+	// a seq of its own.  A server that predates it takes it for a call
+	// to cmd 0 and answers under that seq with an error, or the reply of
+	// its cmd 0 handler; either means version 0.  Clients sending no
+	// metadata never send it, so such servers only see it if metadata is
+	// used with them; see WithMetadata.
+	KindHello
+)
 
 // Response is a header written before every RPC return.  It is used internally
 // but documented here as an aid to debugging, such as when analyzing
 // network traffic.
 type Response struct {
-	Cmd   uint32    // echoes that of the Request
-	Seq   uint32    // echoes that of the request
-	Error uint32    // error, if any.
-	next  *Response // for free list in Server
+	Cmd    uint32 // echoes that of the Request
+	Seq    uint32 // echoes that of the request
+	Error  uint32 // error, if any.
+	Kind   uint8  // kind of frame, KindCall for the reply to a call
+	Window uint32 // credit granted by a KindWindow frame
+	// ErrorBody is set if the body of an error response is a StatusError
+	// rather than a placeholder to discard.
+	ErrorBody bool
+	Version   uint32    // protocol version chosen by a KindHello frame
+	Metadata  Metadata  // sent with the reply if the protocol version is at least 1
+	next      *Response // for free list in Server
 }
 
 // Server represents an RPC Server.
 type Server struct {
-	// mu         sync.RWMutex // protects the serviceMap
-	method   map[uint32]*methodType
-	reqLock  sync.Mutex // protects freeReq
-	freeReq  *Request
-	respLock sync.Mutex // protects freeResp
-	freeResp *Response
+	mu           sync.RWMutex // protects method, interceptors and typeCheck
+	method       map[uint32]*methodType
+	interceptors []Interceptor
+	typeCheck    func(reflect.Type) error // extra check of arg and reply types
+	reqLock      sync.Mutex               // protects freeReq
+	freeReq      *Request
+	respLock     sync.Mutex // protects freeResp
+	freeResp     *Response
+	connLock     sync.Mutex // protects conns and listeners
+	conns        map[*Conn]struct{}
+	listeners    map[net.Listener]struct{}
+	keepalive    Keepalive    // protected by mu
+	compression  *Compression // protected by mu, nil if off
+
+	compressionStats compressionCounters
+
+	inShutdown int32 // accessed atomically, non-zero once Shutdown or Close was called
 }
 
 // NewServer returns a new Server.
 func NewServer() *Server {
-	return &Server{method: make(map[uint32]*methodType)}
+	return &Server{
+		method:    make(map[uint32]*methodType),
+		conns:     make(map[*Conn]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+	}
 }
 
 var DefaultServer = NewServer()
 
-type Error uint32
-
-func (e Error) Error() string {
-	return fmt.Sprintf("%d", uint32(e))
-}
-
 type ServerCodec interface {
 	ReadRequestHeader(*Request) error
 	ReadRequestBody(interface{}) error
@@ -98,6 +174,34 @@ type methodType struct {
 	Func      reflect.Value
 	ArgType   reflect.Type
 	ReplyType reflect.Type
+	connArg   bool         // first argument is *Conn rather than context.Context
+	kind      uint8        // KindCall, KindStream or KindDuplex
+	elemType  reflect.Type // elements received by a duplex stream
+	// call runs the handler without reflection; nil for the handlers
+	// registered with Register, which are run through Func.
+	call func(ctx context.Context, arg, reply interface{}) error
+
+	numCalls uint64 // accessed atomically
+	inFlight int64  // accessed atomically
+	errLock  sync.Mutex
+	errCount map[uint32]uint64 // calls per returned error code
+}
+
+func (m *methodType) NumCalls() uint64 {
+	return atomic.LoadUint64(&m.numCalls)
+}
+
+func (m *methodType) InFlight() int64 {
+	return atomic.LoadInt64(&m.inFlight)
+}
+
+func (m *methodType) countError(code uint32) {
+	m.errLock.Lock()
+	if m.errCount == nil {
+		m.errCount = make(map[uint32]uint64)
+	}
+	m.errCount[code]++
+	m.errLock.Unlock()
 }
 
 // Is this an exported - upper case - name?
@@ -133,9 +237,19 @@ func (server *Server) readRequestHeader(codec ServerCodec) (mtype *methodType, r
 	// we can still recover and move on to the next request.
 	keepReading = true
 
+	if req.Kind != KindCall && req.Kind != KindStream && req.Kind != KindDuplex {
+		// A control frame, handled by the serving loop.
+		return
+	}
+
+	server.mu.RLock()
 	mtype = server.method[req.Cmd]
-	if mtype == nil {
+	server.mu.RUnlock()
+	switch {
+	case mtype == nil:
 		err = errors.New("rpc: can't find method")
+	case req.Kind != mtype.kind:
+		err = errors.New("rpc: request kind does not match method")
 	}
 	return
 }
@@ -190,6 +304,10 @@ func (server *Server) readRequest(codec ServerCodec) (mtype *methodType, req *Re
 		codec.ReadRequestBody(nil)
 		return
 	}
+	if mtype == nil {
+		// A control frame; its body is read by Conn.control.
+		return
+	}
 
 	// Decode the argument value.
 	argIsValue := false // if true, need to indirect before calling.
@@ -207,7 +325,9 @@ func (server *Server) readRequest(codec ServerCodec) (mtype *methodType, req *Re
 		argv = argv.Elem()
 	}
 
-	replyv = reflect.New(mtype.ReplyType.Elem())
+	if mtype.kind == KindCall {
+		replyv = reflect.New(mtype.ReplyType.Elem())
+	}
 	return
 }
 
@@ -249,6 +369,13 @@ func (c *gobServerCodec) WriteResponse(r *Response, body interface{}) (err error
 	return c.encBuf.Flush()
 }
 
+func (c *gobServerCodec) RemoteAddr() net.Addr {
+	if conn, ok := c.rwc.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
 func (c *gobServerCodec) Close() error {
 	if c.closed {
 		// Only call c.rwc.Close once; otherwise the semantics are undefined.
@@ -262,8 +389,30 @@ func (c *gobServerCodec) Close() error {
 // ServeConn blocks, serving the connection until the client hangs up.
 // The caller typically invokes ServeConn in a go statement.
 // ServeConn uses the gob wire format (see package gob) on the
-// connection.  To use an alternate codec, use ServeCodec.
+// connection.  To use an alternate codec, use ServeCodec.  Once enabled
+// with SetCompression, clients that wrap their connection with
+// CompressConn are served compressed data.  On a *tls.Conn, ServeConn completes the
+// handshake first, so that handlers can check the client with
+// ClientSubject.
 func (server *Server) ServeConn(ctx context.Context, conn io.ReadWriteCloser) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		var err error
+		if ctx, err = tlsHandshake(ctx, tc); err != nil {
+			if debugLog {
+				log.Println("rpc: TLS handshake:", err)
+			}
+			conn.Close()
+			return
+		}
+	}
+	server.mu.RLock()
+	compression := server.compression
+	server.mu.RUnlock()
+	if compression != nil {
+		cc := AcceptCompression(conn, *compression)
+		cc.shared = &server.compressionStats
+		conn = cc
+	}
 	buf := bufio.NewWriter(conn)
 	srv := &gobServerCodec{
 		rwc:    conn,
@@ -277,10 +426,32 @@ func (server *Server) ServeConn(ctx context.Context, conn io.ReadWriteCloser) {
 // ServeCodec is like ServeConn but uses the specified codec to
 // decode requests and encode responses.
 func (server *Server) ServeCodec(ctx context.Context, codec ServerCodec) {
-	sending := new(sync.Mutex)
-	arg1 := reflect.ValueOf(ctx)
+	server.serveCodec(ctx, codec, func(pc *PendingCall) {
+		go server.Call(pc)
+	})
+}
+
+// serveCodec reads requests from codec until the peer hangs up and hands
+// every valid one to dispatch.
+func (server *Server) serveCodec(ctx context.Context, codec ServerCodec, dispatch func(*PendingCall)) {
+	if server.shuttingDown() {
+		codec.Close()
+		return
+	}
+	conn := server.newConn(ctx, codec)
+	server.mu.RLock()
+	keepalive := server.keepalive
+	server.mu.RUnlock()
+	var wd *watchdog
+	if keepalive.enabled() {
+		wd = newWatchdog()
+		go wd.run(keepalive, conn.start, conn.ping, conn.idle, func(error) { conn.Close() })
+	}
 	for {
 		mtype, req, argv, replyv, keepReading, err := server.readRequest(codec)
+		if wd != nil && (err == nil || keepReading) {
+			wd.read()
+		}
 		if err != nil {
 			if debugLog && err != io.EOF {
 				log.Println("rpc:", err)
@@ -290,76 +461,103 @@ func (server *Server) ServeCodec(ctx context.Context, codec ServerCodec) {
 			}
 			// send a response if we actually managed to read a header.
 			if req != nil {
-				server.sendResponse(sending, req, invalidRequest, codec, err)
+				server.sendResponse(conn, req, invalidRequest, err, nil)
 				server.freeRequest(req)
 			}
 			continue
 		}
-		go server.call(sending, mtype, req, arg1, argv, replyv, codec)
+		if mtype == nil {
+			err = conn.control(req)
+			server.freeRequest(req)
+			if err != nil {
+				if debugLog {
+					log.Println("rpc:", err)
+				}
+				break
+			}
+			continue
+		}
+		ctx, ok := conn.startCall(req)
+		if !ok {
+			// Shutting down: refuse the request, stop reading and let
+			// the in-flight calls finish.
+			server.sendResponse(conn, req, invalidRequest, ErrShutdown, nil)
+			conn.endCall(req)
+			server.freeRequest(req)
+			break
+		}
+		switch mtype.kind {
+		case KindStream:
+			replyv = reflect.ValueOf(conn.openStream(ctx, req))
+		case KindDuplex:
+			replyv = reflect.ValueOf(conn.openDuplex(ctx, req, mtype.elemType))
+		}
+		dispatch(&PendingCall{
+			conn:   conn,
+			ctx:    ctx,
+			mtype:  mtype,
+			req:    req,
+			argv:   argv,
+			replyv: replyv,
+		})
+	}
+	if wd != nil {
+		wd.stop()
 	}
-	codec.Close()
+	conn.finish()
+	server.removeConn(conn)
+}
+
+// SetKeepalive sets the liveness checks of the connections served from
+// then on.
+func (server *Server) SetKeepalive(k Keepalive) {
+	server.mu.Lock()
+	server.keepalive = k
+	server.mu.Unlock()
+}
+
+// SetTypeCheck makes the handlers registered from then on fail to register
+// unless check accepts their argument and reply types, and the elements of
+// their streams.  Codecs that cannot carry every type use it to reject
+// handlers they could not serve.
+func (server *Server) SetTypeCheck(check func(reflect.Type) error) {
+	server.mu.Lock()
+	server.typeCheck = check
+	server.mu.Unlock()
 }
 
 // test
 type PendingCall struct {
-	sending *sync.Mutex
-	mtype   *methodType
-	req     *Request
-	arg1    reflect.Value
-	argv    reflect.Value
-	replyv  reflect.Value
-	codec   ServerCodec
+	conn   *Conn
+	ctx    context.Context
+	mtype  *methodType
+	req    *Request
+	argv   reflect.Value
+	replyv reflect.Value
 }
 
 func (pc *PendingCall) Context() context.Context {
-	return pc.arg1.Interface().(context.Context)
+	return pc.ctx
 }
 
 // test
 func (server *Server) ServeCodec2(ctx context.Context, codec ServerCodec, ch chan interface{}) {
-	sending := new(sync.Mutex)
-	arg1 := reflect.ValueOf(ctx)
-	for {
-		mtype, req, argv, replyv, keepReading, err := server.readRequest(codec)
-		if err != nil {
-			if debugLog && err != io.EOF {
-				log.Println("rpc:", err)
-			}
-			if !keepReading {
-				break
-			}
-			// send a response if we actually managed to read a header.
-			if req != nil {
-				server.sendResponse(sending, req, invalidRequest, codec, err)
-				server.freeRequest(req)
-			}
-			continue
-		}
-		ch <- &PendingCall{
-			sending: sending,
-			mtype:   mtype,
-			req:     req,
-			arg1:    arg1,
-			argv:    argv,
-			replyv:  replyv,
-			codec:   codec,
-		}
-		// go server.call(sending, mtype, req, arg1, argv, replyv, codec)
-	}
-	codec.Close()
+	server.serveCodec(ctx, codec, func(pc *PendingCall) {
+		ch <- pc
+	})
 }
 
 // test
 func (server *Server) Call(pc interface{}) {
 	call := pc.(*PendingCall)
-	server.call(call.sending, call.mtype, call.req, call.arg1, call.argv, call.replyv, call.codec)
+	server.call(call.conn, call.ctx, call.mtype, call.req, call.argv, call.replyv)
 }
 
 // test
 // func (server *Server) callWithChan(ch chan *PendingCall) {
 // 	for {
 // 		call := <-ch
-// 		server.call(call.sending, call.mtype, call.req, call.arg1, call.argv, call.replyv, call.codec)
+// 		server.call(call.conn, call.ctx, call.mtype, call.req, call.argv, call.replyv)
 // 	}
 // }
 
@@ -368,55 +566,225 @@ func (server *Server) Call(pc interface{}) {
 // contains an error when it is used.
 var invalidRequest = struct{}{}
 
-func (server *Server) sendResponse(sending *sync.Mutex, req *Request, reply interface{}, codec ServerCodec, errmsg error) {
+func (server *Server) sendResponse(conn *Conn, req *Request, reply interface{}, errmsg error, md Metadata) {
 	resp := server.getResponse()
 	// Encode the response header
 	resp.Cmd = req.Cmd
+	if len(md) > 0 && conn.protocolVersion() >= 1 {
+		resp.Metadata = md
+	}
+	switch req.Kind {
+	case KindStream:
+		resp.Kind = KindStreamEnd
+		reply = invalidRequest
+	case KindDuplex:
+		resp.Kind = KindStreamReset
+		reply = invalidRequest
+	}
 	if errmsg != nil {
-		errcode, ok := errmsg.(Error)
-		if ok {
-			resp.Error = uint32(errcode)
-		} else {
-			resp.Error = uint32(0xFFFFFFFF)
+		resp.Error = errorCode(errmsg)
+		if status := errorStatus(errmsg); status != nil {
+			resp.ErrorBody = true
+			reply = status
 		}
 	}
 	resp.Seq = req.Seq
-	sending.Lock()
-	err := codec.WriteResponse(resp, reply)
+	conn.sending.Lock()
+	err := conn.codec.WriteResponse(resp, reply)
 	if debugLog && err != nil {
 		log.Println("rpc: writing response:", err)
 	}
-	sending.Unlock()
+	conn.sending.Unlock()
 	server.freeResponse(resp)
 }
 
-func (server *Server) call(sending *sync.Mutex, mtype *methodType, req *Request, arg1, argv, replyv reflect.Value, codec ServerCodec) {
-	function := mtype.Func
-	// Invoke the method, providing a new value for the reply.
-	returnValues := function.Call([]reflect.Value{arg1, argv, replyv})
-	// The return value for the method is an error.
-	errInter := returnValues[0].Interface()
-	var err error
-	if errInter != nil {
-		err = errInter.(error)
+func (server *Server) call(conn *Conn, ctx context.Context, mtype *methodType, req *Request, argv, replyv reflect.Value) {
+	reply, err := server.invoke(ctx, conn, mtype, req.Cmd, argv.Interface(), replyv.Interface())
+	switch {
+	case ctx.Err() != nil:
+		// The client has given up on a cancelled call; don't bother replying.
+	case mtype.kind == KindDuplex && !replyv.Interface().(*Duplex).handlerDone():
+		// The stream has been reset.
+	default:
+		server.sendResponse(conn, req, reply, err, replyMetadata(ctx))
 	}
-	server.sendResponse(sending, req, replyv.Interface(), codec, err)
+	conn.endCall(req)
 	server.freeRequest(req)
 }
 
+// invoke runs the handler of cmd through the interceptor chain.  It
+// returns the reply the handler wrote to, which an interceptor may have
+// replaced.
+func (server *Server) invoke(ctx context.Context, conn *Conn, mtype *methodType, cmd uint32, arg, reply interface{}) (interface{}, error) {
+	atomic.AddUint64(&mtype.numCalls, 1)
+	atomic.AddInt64(&mtype.inFlight, 1)
+	defer atomic.AddInt64(&mtype.inFlight, -1)
+
+	written := reply
+	handler := func(ctx context.Context, cmd uint32, arg, reply interface{}) error {
+		if err := mtype.checkArgs(arg, reply); err != nil {
+			return err
+		}
+		written = reply
+		if mtype.call != nil {
+			return mtype.call(ctx, arg, reply)
+		}
+		function := mtype.Func
+		arg1 := reflect.ValueOf(ctx)
+		if mtype.connArg {
+			arg1 = reflect.ValueOf(conn)
+		}
+		argv := reflect.ValueOf(arg)
+		if arg == nil {
+			argv = reflect.Zero(mtype.ArgType)
+		}
+		// Invoke the method, providing a new value for the reply.
+		returnValues := function.Call([]reflect.Value{arg1, argv, reflect.ValueOf(reply)})
+		// The return value for the method is an error.
+		errInter := returnValues[0].Interface()
+		if errInter != nil {
+			return errInter.(error)
+		}
+		return nil
+	}
+	server.mu.RLock()
+	interceptors := server.interceptors
+	server.mu.RUnlock()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		handler = chain(interceptors[i], handler)
+	}
+
+	err := handler(ctx, cmd, arg, reply)
+	if err != nil {
+		mtype.countError(errorCode(err))
+	}
+	return written, err
+}
+
+// checkArgs returns an error if arg and reply, as handed down the
+// interceptor chain, do not fit the handler.
+func (m *methodType) checkArgs(arg, reply interface{}) error {
+	if !fits(arg, m.ArgType) {
+		return fmt.Errorf("rpc: argument of type %T passed to a handler of %v", arg, m.ArgType)
+	}
+	if !fits(reply, m.ReplyType) {
+		return fmt.Errorf("rpc: reply of type %T passed to a handler of %v", reply, m.ReplyType)
+	}
+	return nil
+}
+
+// fits reports whether v can be passed as a t.  nil and nil pointers only
+// fit interface types.
+func fits(v interface{}, t reflect.Type) bool {
+	if v == nil {
+		return t.Kind() == reflect.Interface
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.Type().AssignableTo(t) {
+		return false
+	}
+	return rv.Kind() != reflect.Ptr || !rv.IsNil()
+}
+
+func chain(interceptor Interceptor, next Handler) Handler {
+	return func(ctx context.Context, cmd uint32, arg, reply interface{}) error {
+		return interceptor(ctx, cmd, arg, reply, next)
+	}
+}
+
+// A Handler dispatches a call to the function registered for cmd.  arg and
+// reply are the decoded argument and the pointer the reply is written to.
+type Handler func(ctx context.Context, cmd uint32, arg, reply interface{}) error
+
+// An Interceptor wraps the dispatch of every call.  It may inspect or
+// replace ctx, arg and reply, decide not to call next at all, or recover
+// from panics raised further down the chain.  A replacement arg or reply
+// must have the type the handler takes, or the call fails without
+// reaching it; the client gets the reply the handler wrote to.  The error
+// the interceptor returns is the one sent to the client.
+type Interceptor func(ctx context.Context, cmd uint32, arg, reply interface{}, next Handler) error
+
+// Use appends interceptors to the chain wrapping every call dispatched by
+// the server.  The first interceptor added is the outermost one.
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.mu.Lock()
+	server.interceptors = append(server.interceptors[:len(server.interceptors):len(server.interceptors)], interceptors...)
+	server.mu.Unlock()
+}
+
+// Register publishes function as the handler of cmd.  function must look
+// like
+//
+//	func(ctx context.Context, args T1, reply *T2) error
+//
+// or, to work with the connection directly,
+//
+//	func(conn *Conn, args T1, reply *T2) error
 func (server *Server) Register(cmd uint32, function interface{}) error {
+	return server.register(cmd, function, KindCall, nil, nil)
+}
+
+// RegisterStream publishes function as the handler of the stream cmd.
+// function must look like
+//
+//	func(ctx context.Context, args T1, stream *ServerStream) error
+//
+// or take a *Conn as its first argument.  It sends the elements of the
+// stream with stream.Send; the stream ends when it returns.
+func (server *Server) RegisterStream(cmd uint32, function interface{}) error {
+	return server.register(cmd, function, KindStream, nil, nil)
+}
+
+// RegisterDuplex publishes function as the handler of the duplex stream
+// cmd.  function must look like
+//
+//	func(ctx context.Context, args T1, stream *Duplex) error
+//
+// or take a *Conn as its first argument.  elem gives the type of the
+// elements sent by the client, as for Client.OnNotify.  The stream is
+// reset when function returns.
+func (server *Server) RegisterDuplex(cmd uint32, function interface{}, elem interface{}) error {
+	if elem == nil {
+		return errors.New("duplex element type is nil")
+	}
+	return server.register(cmd, function, KindDuplex, elemType(elem), nil)
+}
+
+// register checks the signature of function and publishes it for cmd.  If
+// call is not nil, it runs the handler in place of function.
+func (server *Server) register(cmd uint32, function interface{}, kind uint8, elem reflect.Type, call func(context.Context, interface{}, interface{}) error) error {
 	mtype := reflect.TypeOf(function)
-	// Method needs three ins: receiver, *args, *reply.
+	if mtype == nil || mtype.Kind() != reflect.Func {
+		return errors.New("handler is not a function")
+	}
+	// Method needs three ins: context or conn, *args, *reply.
 	if mtype.NumIn() != 3 {
 		return errors.New("method has wrong number of ins")
 	}
+	// First arg is either the call context or the connection.
+	connArg := false
+	switch mtype.In(0) {
+	case typeOfContext:
+	case typeOfConn:
+		connArg = true
+	default:
+		return errors.New("first argument is neither context.Context nor *rpc.Conn")
+	}
 	// First arg need not be a pointer.
 	argType := mtype.In(1)
 	if !isExportedOrBuiltinType(argType) {
 		return errors.New("argument type not exported")
 	}
-	// Second arg must be a pointer.
+	// Second arg must be a pointer, to a stream for the streams.
 	replyType := mtype.In(2)
+	switch {
+	case kind == KindStream && replyType != typeOfServerStream:
+		return errors.New("stream handler does not take a *rpc.ServerStream")
+	case kind == KindDuplex && replyType != typeOfDuplex:
+		return errors.New("duplex handler does not take a *rpc.Duplex")
+	case kind == KindCall && (replyType == typeOfServerStream || replyType == typeOfDuplex):
+		return errors.New("handler takes a stream, use RegisterStream or RegisterDuplex")
+	}
 	if replyType.Kind() != reflect.Ptr {
 		return errors.New("reply type not a pointer")
 	}
@@ -432,7 +800,26 @@ func (server *Server) Register(cmd uint32, function interface{}) error {
 	if returnType := mtype.Out(0); returnType != typeOfError {
 		return errors.New("not error")
 	}
-	server.method[cmd] = &methodType{Func: reflect.ValueOf(function), ArgType: argType, ReplyType: replyType}
+	// The codec may restrict the types it can carry.
+	server.mu.RLock()
+	typeCheck := server.typeCheck
+	server.mu.RUnlock()
+	if typeCheck != nil {
+		if err := typeCheck(argType); err != nil {
+			return err
+		}
+		if err := typeCheck(replyType); kind == KindCall && err != nil {
+			return err
+		}
+		if elem != nil {
+			if err := typeCheck(elem); err != nil {
+				return err
+			}
+		}
+	}
+	server.mu.Lock()
+	server.method[cmd] = &methodType{Func: reflect.ValueOf(function), ArgType: argType, ReplyType: replyType, connArg: connArg, kind: kind, elemType: elem, call: call}
+	server.mu.Unlock()
 	return nil
 }
 
@@ -454,5 +841,158 @@ func ServeCodec(codec ServerCodec) {
 // Register publishes the receiver's methods in the DefaultServer.
 func Register(cmd uint32, function interface{}) error { return DefaultServer.Register(cmd, function) }
 
+// ErrServerClosed is returned by Serve after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("rpc: Server closed")
+
+// shutdownPollInterval is how often Shutdown looks for idle connections.
+const shutdownPollInterval = 50 * time.Millisecond
+
+func (server *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&server.inShutdown) != 0
+}
+
+// Serve accepts connections on the listener and serves requests for each
+// incoming connection.  Serve blocks until the listener returns an error
+// and always returns a non-nil error; after Shutdown or Close the returned
+// error is ErrServerClosed.
+func (server *Server) Serve(l net.Listener) error {
+	server.connLock.Lock()
+	if server.shuttingDown() {
+		server.connLock.Unlock()
+		return ErrServerClosed
+	}
+	server.listeners[l] = struct{}{}
+	server.connLock.Unlock()
+	defer func() {
+		server.connLock.Lock()
+		delete(server.listeners, l)
+		server.connLock.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if server.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go server.ServeConn(context.Background(), conn)
+	}
+}
+
+// closeListeners closes all listeners.  server.connLock must be held.
+func (server *Server) closeListeners() error {
+	var err error
+	for l := range server.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(server.listeners, l)
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the server: it closes all listeners, stops
+// reading new requests, waits for in-flight calls to send their responses
+// and then closes the connections.  A request read as the server starts
+// shutting down is answered with ErrShutdown.  If ctx expires first, Shutdown returns
+// the context's error and the remaining connections are left to finish on
+// their own; use Close to drop them.
+func (server *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&server.inShutdown, 1)
+	server.connLock.Lock()
+	lnerr := server.closeListeners()
+	server.connLock.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if server.closeIdleConns() {
+			return lnerr
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes the connections without calls in flight and
+// reports whether all connections are gone.
+func (server *Server) closeIdleConns() bool {
+	server.connLock.Lock()
+	conns := make([]*Conn, 0, len(server.conns))
+	for c := range server.conns {
+		conns = append(conns, c)
+	}
+	server.connLock.Unlock()
+	for _, c := range conns {
+		c.closeIfIdle()
+	}
+	return len(conns) == 0
+}
+
+// Close immediately closes all listeners and connections.  Calls still in
+// flight run to completion but their responses are lost.
+func (server *Server) Close() error {
+	atomic.StoreInt32(&server.inShutdown, 1)
+	server.connLock.Lock()
+	err := server.closeListeners()
+	conns := make([]*Conn, 0, len(server.conns))
+	for c := range server.conns {
+		conns = append(conns, c)
+	}
+	server.connLock.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return err
+}
+
+// Serve accepts connections on the listener and serves them with
+// DefaultServer.
+func Serve(l net.Listener) error {
+	return DefaultServer.Serve(l)
+}
+
 // Can connect to RPC service using HTTP CONNECT to rpcPath.
 var connected = "200 Connected to Go RPC"
+
+// ServeHTTP implements an http.Handler that answers RPC requests.
+func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
+	server.ServeConn(context.Background(), conn)
+}
+
+// HandleHTTP registers an HTTP handler for RPC messages on rpcPath.
+// It is still necessary to invoke http.Serve(), typically in a go statement.
+func (server *Server) HandleHTTP(rpcPath string) {
+	http.Handle(rpcPath, server)
+}
+
+// HandleDebugHTTP registers a debugging handler on debugPath.
+// It is still necessary to invoke http.Serve(), typically in a go statement.
+func (server *Server) HandleDebugHTTP(debugPath string) {
+	http.Handle(debugPath, debugHTTP{server})
+}
+
+// HandleHTTP registers an HTTP handler for RPC messages to DefaultServer
+// on DefaultRPCPath and a debugging handler on DefaultDebugPath.
+// It is still necessary to invoke http.Serve(), typically in a go statement.
+func HandleHTTP() {
+	DefaultServer.HandleHTTP(DefaultRPCPath)
+	DefaultServer.HandleDebugHTTP(DefaultDebugPath)
+}
@@ -1,7 +1,16 @@
 package rpc
 
 import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -12,17 +21,17 @@ type AddParams struct {
 	A, B int
 }
 
-func Add(codec ServerCodec, arg *AddParams, reply *int) error {
+func Add(conn *Conn, arg *AddParams, reply *int) error {
 	*reply = arg.A + arg.B
 	return nil
 }
 
-func Fail(codec ServerCodec, arg *AddParams, reply *int) error {
+func Fail(ctx context.Context, arg *AddParams, reply *int) error {
 	*reply = arg.A + arg.B
 	return Error(777)
 }
 
-func Timeout(codec ServerCodec, arg *AddParams, reply *int) error {
+func Timeout(ctx context.Context, arg *AddParams, reply *int) error {
 	*reply = arg.A + arg.B
 	time.Sleep(1 * time.Second)
 	return nil
@@ -32,23 +41,20 @@ func runServer(t *testing.T) {
 	if runserver {
 		return
 	}
-	var err error
-	err = Register(100, Add)
-	err = Register(101, Fail)
-	err = Register(102, Timeout)
+	if err := Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(101, Fail); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(102, Timeout); err != nil {
+		t.Fatal(err)
+	}
 	l, err := net.Listen("tcp", ":20003")
 	if err != nil {
 		t.Fatal(err)
 	}
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				t.Fatal(err)
-			}
-			ServeConn(conn)
-		}
-	}()
+	go Serve(l)
 	runserver = true
 }
 
@@ -142,3 +148,561 @@ func TestTimeoutCall4(t *testing.T) {
 		t.Fatal("should return nil, but:", call.Error)
 	}
 }
+
+type Sum struct {
+	Total int
+}
+
+func AddNotify(ctx context.Context, arg *AddParams, reply *int) error {
+	*reply = arg.A + arg.B
+	return ConnFromContext(ctx).Notify(200, &Sum{*reply})
+}
+
+func TestNotify(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(103, AddNotify); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+
+	ch := make(chan int, 1)
+	c.OnNotify(200, Sum{}, func(cmd uint32, body interface{}) {
+		ch <- body.(*Sum).Total
+	})
+	reply := 0
+	if err := c.Call(103, &AddParams{1, 2}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case total := <-ch:
+		if total != 3 {
+			t.Fatal("notify total:", total)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notification not delivered")
+	}
+}
+
+// TestNotifyNilBody checks notifications without payload, registered with
+// a nil body.
+func TestNotifyNilBody(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(103, func(ctx context.Context, arg *AddParams, reply *int) error {
+		*reply = arg.A + arg.B
+		return ConnFromContext(ctx).Notify(201, nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+
+	ch := make(chan interface{}, 1)
+	c.OnNotify(201, nil, func(cmd uint32, body interface{}) {
+		ch <- body
+	})
+	reply := 0
+	for i := 0; i < 2; i++ {
+		if err := c.Call(103, &AddParams{1, i}, &reply); err != nil || reply != 1+i {
+			t.Fatal("call:", reply, err)
+		}
+		select {
+		case body := <-ch:
+			if body != nil {
+				t.Fatal("notification body:", body)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("notification not delivered")
+		}
+	}
+}
+
+func TestSeqWraparound(t *testing.T) {
+	runServer(t)
+	c := runClient(t)
+	defer c.Close()
+
+	// Park a call on seq 1 so the counter has to skip it after wrapping.
+	c.mutex.Lock()
+	c.seq = 1
+	c.mutex.Unlock()
+	slow := c.Go(102, &AddParams{1, 1}, new(int), nil)
+
+	c.mutex.Lock()
+	c.seq = 0xFFFFFFFE
+	c.mutex.Unlock()
+	seqs := make(map[uint32]bool)
+	for i := 0; i < 4; i++ {
+		reply := 0
+		call := <-c.Go(100, &AddParams{i, 1}, &reply, nil).Done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+		if reply != i+1 {
+			t.Fatal("call", i, "got reply", reply)
+		}
+		seqs[call.Seq] = true
+	}
+	if seqs[0] || seqs[1] {
+		t.Fatal("reserved or in-use seq reused:", seqs)
+	}
+	if !seqs[0xFFFFFFFE] || !seqs[0xFFFFFFFF] || !seqs[2] || !seqs[3] {
+		t.Fatal("unexpected seqs after wraparound:", seqs)
+	}
+	if (<-slow.Done).Error != nil {
+		t.Fatal(slow.Error)
+	}
+}
+
+type loginKey struct{}
+
+func Login(conn *Conn, name string, reply *uint64) error {
+	conn.SetValue(loginKey{}, name)
+	*reply = conn.ID()
+	return nil
+}
+
+func WhoAmI(ctx context.Context, arg int, reply *string) error {
+	name, ok := ConnValue[string](ConnFromContext(ctx), loginKey{})
+	if !ok {
+		return Error(1)
+	}
+	*reply = name
+	return nil
+}
+
+func TestConnSession(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(1, Login); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(2, WhoAmI); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed := make(chan uint64, 2)
+	go server.Serve(l)
+
+	dial := func() *Client {
+		c, err := Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c1, c2 := dial(), dial()
+	defer c2.Close()
+
+	var id1, id2 uint64
+	if err := c1.Call(1, "alice", &id1); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := c1.Call(2, 0, &name); err != nil || name != "alice" {
+		t.Fatal("whoami:", name, err)
+	}
+	// State is per connection.
+	if err := c2.Call(2, 0, &name); err != Error(1) {
+		t.Fatal("second connection should not be logged in:", err)
+	}
+	if err := c2.Call(1, "bob", &id2); err != nil {
+		t.Fatal(err)
+	}
+	if id1 == id2 {
+		t.Fatal("connections share id", id1)
+	}
+
+	server.connLock.Lock()
+	for conn := range server.conns {
+		if conn.RemoteAddr() == nil {
+			t.Error("conn", conn.ID(), "has no remote address")
+		}
+		conn.OnClose(func(conn *Conn) { closed <- conn.ID() })
+	}
+	server.connLock.Unlock()
+
+	c1.Close()
+	select {
+	case id := <-closed:
+		if id != id1 {
+			t.Fatal("close hook ran for", id, "want", id1)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close hook not run")
+	}
+}
+
+func TestRegisterWrongFirstArg(t *testing.T) {
+	server := NewServer()
+	bad := func(codec ServerCodec, arg *AddParams, reply *int) error { return nil }
+	if err := server.Register(1, bad); err == nil {
+		t.Fatal("Register accepted a handler taking a ServerCodec")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(DefaultRPCPath, server)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, mux)
+
+	c, err := DialHTTP("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reply := 0
+	if err := c.Call(100, &AddParams{7, 8}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 15 {
+		t.Fatal("call over HTTP got", reply)
+	}
+
+	if _, err := DialHTTPPath("tcp", l.Addr().String(), "/nowhere"); err == nil {
+		t.Fatal("dial to wrong path should fail")
+	}
+}
+
+func TestDebugHTTP(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(101, Fail); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+	reply := 0
+	c.Call(100, &AddParams{1, 2}, &reply)
+	c.Call(101, &AddParams{1, 2}, &reply)
+
+	w := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", DefaultDebugPath, nil))
+	body := w.Body.String()
+	for _, want := range []string{"rpc.Add", "rpc.Fail", "*rpc.AddParams", "777: 1", "<td align=right>1</td>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("debug page missing %q:\n%s", want, body)
+		}
+	}
+}
+
+// blockingAdd returns a handler that signals started once called and
+// replies the sum once release is closed.
+func blockingAdd(started chan<- struct{}, release <-chan struct{}) func(context.Context, *AddParams, *int) error {
+	return func(ctx context.Context, arg *AddParams, reply *int) error {
+		started <- struct{}{}
+		<-release
+		*reply = arg.A + arg.B
+		return nil
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server := NewServer()
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	if err := server.Register(102, blockingAdd(started, release)); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reply := 0
+	call := c.Go(102, &AddParams{1, 2}, &reply, nil)
+	<-started
+
+	// The call in flight keeps Shutdown from completing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := server.Shutdown(ctx); err != context.Canceled {
+		t.Fatalf("Shutdown with a call in flight returned %v, want %v", err, context.Canceled)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatal("Serve returned", err)
+	}
+	// A request read once shutting down is refused rather than dropped.
+	if err := c.CallWithTimeout(102, &AddParams{1, 2}, new(int), 5*time.Second); err == nil || !strings.Contains(err.Error(), ErrShutdown.Error()) {
+		t.Fatal("call during shutdown returned", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	close(release)
+	<-call.Done
+	if call.Error != nil || reply != 3 {
+		t.Fatal("in-flight call lost:", reply, call.Error)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal("Shutdown returned", err)
+	}
+	if err := c.Call(102, &AddParams{1, 2}, &reply); err == nil {
+		t.Fatal("call after shutdown succeeded")
+	}
+	if _, err := Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("dial after shutdown succeeded")
+	}
+}
+
+func TestClose(t *testing.T) {
+	server := NewServer()
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	if err := server.Register(102, blockingAdd(started, release)); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	call := c.Go(102, &AddParams{1, 2}, new(int), nil)
+	<-started
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatal("Serve returned", err)
+	}
+	// Close drops the connection without waiting for the handler.
+	<-call.Done
+	if call.Error == nil {
+		t.Fatal("call survived Close")
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	server := NewServer()
+	type result struct {
+		hasDeadline bool
+		err         error
+	}
+	handled := make(chan result, 1)
+	wait := func(ctx context.Context, arg int, reply *int) error {
+		_, ok := ctx.Deadline()
+		<-ctx.Done()
+		handled <- result{ok, ctx.Err()}
+		*reply = arg
+		return nil
+	}
+	if err := server.Register(1, wait); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+
+	// Deadline is transmitted and enforced on the server.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	reply := 0
+	if err := c.CallContext(ctx, 1, 42, &reply); err != context.DeadlineExceeded {
+		t.Fatal("CallContext returned", err)
+	}
+	r := <-handled
+	if !r.hasDeadline || r.err == nil {
+		t.Fatal("server context had no deadline or was not done:", r)
+	}
+
+	// Explicit cancellation reaches the handler.
+	ctx, cancel = context.WithCancel(context.Background())
+	call := c.GoContext(ctx, 1, 43, &reply, nil)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	<-call.Done
+	if call.Error != context.Canceled {
+		t.Fatal("cancelled call returned", call.Error)
+	}
+	select {
+	case r := <-handled:
+		if r.hasDeadline || r.err != context.Canceled {
+			t.Fatal("unexpected server context state:", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancel frame did not reach the server")
+	}
+	if reply != 0 {
+		t.Fatal("reply of a cancelled call was written:", reply)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	panics := func(ctx context.Context, arg int, reply *int) error {
+		panic("boom")
+	}
+	if err := server.Register(1, panics); err != nil {
+		t.Fatal(err)
+	}
+	var trace []string
+	var mu sync.Mutex
+	record := func(s string) {
+		mu.Lock()
+		trace = append(trace, s)
+		mu.Unlock()
+	}
+	server.Use(func(ctx context.Context, cmd uint32, arg, reply interface{}, next Handler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = Error(500)
+			}
+		}()
+		record("recover")
+		return next(ctx, cmd, arg, reply)
+	}, func(ctx context.Context, cmd uint32, arg, reply interface{}, next Handler) error {
+		record(fmt.Sprintf("log %d", cmd))
+		return next(ctx, cmd, arg, reply)
+	})
+
+	// Calls dispatched through ServeCodec2 and Server.Call go through the
+	// same chain.
+	cli, srv := net.Pipe()
+	buf := bufio.NewWriter(srv)
+	codec := &gobServerCodec{rwc: srv, dec: gob.NewDecoder(srv), enc: gob.NewEncoder(buf), encBuf: buf}
+	ch := make(chan interface{}, 1)
+	go server.ServeCodec2(context.Background(), codec, ch)
+	go func() {
+		for pc := range ch {
+			go server.Call(pc)
+		}
+	}()
+	c := NewClient(cli)
+	defer c.Close()
+
+	reply := 0
+	if err := c.Call(100, &AddParams{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call through interceptors:", reply, err)
+	}
+	if err := c.Call(1, 0, &reply); err != Error(500) {
+		t.Fatal("panic not recovered by interceptor:", err)
+	}
+	want := []string{"recover", "log 100", "recover", "log 1"}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(trace) != fmt.Sprint(want) {
+		t.Fatal("interceptor order:", trace)
+	}
+}
+
+func TestInterceptorReplace(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	if err := Handle(server, 101, typedAdd); err != nil {
+		t.Fatal(err)
+	}
+	server.Use(func(ctx context.Context, cmd uint32, arg, reply interface{}, next Handler) error {
+		switch arg.(*AddParams).A {
+		case 10:
+			// The client gets the reply the handler wrote to.
+			return next(ctx, cmd, &AddParams{1, 1}, new(int))
+		case 20:
+			return next(ctx, cmd, "oops", reply)
+		case 30:
+			return next(ctx, cmd, (*AddParams)(nil), reply)
+		case 40:
+			return next(ctx, cmd, arg, new(string))
+		case 50:
+			return next(ctx, cmd, arg, nil)
+		}
+		return next(ctx, cmd, arg, reply)
+	})
+	c := typedPair(server)
+	defer c.Close()
+
+	for _, cmd := range []uint32{100, 101} {
+		reply := 0
+		if err := c.Call(cmd, &AddParams{10, 0}, &reply); err != nil || reply != 2 {
+			t.Fatalf("cmd %d: replaced reply: %d, %v", cmd, reply, err)
+		}
+		for _, a := range []int{20, 30, 40, 50} {
+			err := c.Call(cmd, &AddParams{a, 0}, &reply)
+			if errorCode(err) != uint32(ErrInternal) {
+				t.Errorf("cmd %d: replacement %d returned %v, want %v", cmd, a, err, ErrInternal)
+			}
+		}
+		// The server survived the bad replacements.
+		if err := c.Call(cmd, &AddParams{1, 2}, &reply); err != nil || reply != 3 {
+			t.Fatalf("cmd %d: call after bad replacements: %d, %v", cmd, reply, err)
+		}
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	server := NewServer()
+	if err := server.Register(100, Add); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(101, Fail); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.JSONHandler())
+	defer ts.Close()
+
+	post := func(body string) string {
+		t.Helper()
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return strings.TrimSpace(string(b))
+	}
+
+	if got, want := post(`{"cmd":100,"seq":1,"params":{"A":1,"B":2}}`),
+		`{"cmd":100,"seq":1,"error":"","result":3}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := post(`[{"cmd":101,"seq":2,"params":{"A":1,"B":2}},{"cmd":999,"seq":3}]`),
+		`[{"cmd":101,"seq":2,"error":"777","result":null},{"cmd":999,"seq":3,"error":"rpc: can't find method","result":null}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("GET answered with", resp.Status)
+	}
+}
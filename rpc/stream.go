@@ -0,0 +1,423 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// DefaultStreamWindow is the number of stream elements a receiver lets
+// the sender run ahead of the ones it has received.
+const DefaultStreamWindow = 16
+
+// ErrNoStreams is returned when a stream is opened with a codec that
+// cannot carry streams, or by ClientStream.Recv when the server answered
+// the stream with a plain reply, as servers that predate streams do.
+var ErrNoStreams = errors.New("rpc: streams not supported")
+
+var errWindowExceeded = errors.New("rpc: stream window exceeded")
+
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil))
+
+// credit counts the elements a stream may send before the receiver makes
+// room for more.
+type credit struct {
+	mu        sync.Mutex // protects following
+	n         uint32
+	unlimited bool
+	wake      chan struct{} // signalled when credit is granted
+}
+
+func newCredit(n uint32, unlimited bool) *credit {
+	return &credit{n: n, unlimited: unlimited, wake: make(chan struct{}, 1)}
+}
+
+// wait consumes one unit of credit, waiting for the receiver to grant
+// some if there is none left.  It returns the cause of ctx if ctx is done
+// first.
+func (c *credit) wait(ctx context.Context) error {
+	for !c.take() {
+		select {
+		case <-c.wake:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+	return nil
+}
+
+// take consumes one unit of credit, reporting false if there is none.
+func (c *credit) take() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.unlimited {
+		return true
+	}
+	if c.n == 0 {
+		return false
+	}
+	c.n--
+	return true
+}
+
+// grant lets the stream send n more elements.
+func (c *credit) grant(n uint32) {
+	c.mu.Lock()
+	if c.n > math.MaxUint32-n {
+		c.n = math.MaxUint32
+	} else {
+		c.n += n
+	}
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// inbox buffers the elements received on a stream until they are read.
+// A single goroutine adds elements and a single one reads them.  The
+// sender never has more than window elements in flight, so items never
+// fills up; one more slot is kept for the error ending the stream.
+type inbox struct {
+	typ    reflect.Type
+	window uint32
+	items  chan streamItem // elements, then the error ending the stream
+
+	// Owned by the reading goroutine.
+	consumed uint32
+	err      error
+}
+
+type streamItem struct {
+	v   interface{}
+	err error
+}
+
+func newInbox(typ reflect.Type, window uint32) *inbox {
+	return &inbox{typ: typ, window: window, items: make(chan streamItem, window+1)}
+}
+
+// put adds v, reporting false if the sender overran the window.
+func (b *inbox) put(v interface{}) bool {
+	// Only this goroutine adds elements, so the length can only shrink
+	// between the check and the send.
+	if len(b.items) >= int(b.window) {
+		return false
+	}
+	b.items <- streamItem{v: v}
+	return true
+}
+
+// end delivers the error ending the stream, io.EOF for a clean end.  If
+// drop is set, the elements not read yet are discarded first.  end must
+// be called at most once.
+func (b *inbox) end(err error, drop bool) {
+	for drop && len(b.items) > 0 {
+		select {
+		case <-b.items:
+		default:
+		}
+	}
+	b.items <- streamItem{err: err}
+}
+
+// next returns the next element, or the error ending the stream, or the
+// cause of ctx if ctx is done first.  grant is the number of elements to
+// hand back to the sender, 0 until half the window has been read.
+func (b *inbox) next(ctx context.Context) (v interface{}, grant uint32, err error) {
+	if b.err != nil {
+		return nil, 0, b.err
+	}
+	var it streamItem
+	select {
+	case it = <-b.items:
+	default:
+		select {
+		case it = <-b.items:
+		case <-ctx.Done():
+			return nil, 0, context.Cause(ctx)
+		}
+	}
+	if it.err != nil {
+		b.err = it.err
+		return nil, 0, it.err
+	}
+	b.consumed++
+	if b.consumed >= (b.window+1)/2 {
+		grant, b.consumed = b.consumed, 0
+	}
+	return it.v, grant, nil
+}
+
+// elemType returns the type elements are decoded into for the sample elem.
+func elemType(elem interface{}) reflect.Type {
+	typ := reflect.TypeOf(elem)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+// ServerStream sends the elements of a stream opened by the client.  Send
+// blocks while the client has no room left for more elements, so a slow
+// client slows the handler down instead of piling up frames in memory.
+type ServerStream struct {
+	conn *Conn
+	ctx  context.Context
+	cmd  uint32
+	seq  uint32
+	out  *credit
+}
+
+// openStream registers the stream opened by req so that KindWindow
+// frames reach it.
+func (c *Conn) openStream(ctx context.Context, req *Request) *ServerStream {
+	s := &ServerStream{
+		conn: c,
+		ctx:  ctx,
+		cmd:  req.Cmd,
+		seq:  req.Seq,
+		out:  newCredit(req.Window, req.Window == 0),
+	}
+	c.mu.Lock()
+	if c.streams == nil {
+		c.streams = make(map[uint32]*ServerStream)
+	}
+	c.streams[req.Seq] = s
+	c.mu.Unlock()
+	return s
+}
+
+// Context returns the context of the stream, which is done when the
+// client cancels the stream or goes away.
+func (s *ServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// Conn returns the connection the stream belongs to.
+func (s *ServerStream) Conn() *Conn {
+	return s.conn
+}
+
+// Send writes v as the next element of the stream, waiting for the client
+// to make room for it.  It returns the cause of the stream's context if
+// the stream is cancelled meanwhile.
+func (s *ServerStream) Send(v interface{}) error {
+	if err := s.out.wait(s.ctx); err != nil {
+		return err
+	}
+	if s.ctx.Err() != nil {
+		return context.Cause(s.ctx)
+	}
+	return s.conn.writeFrame(&Response{Cmd: s.cmd, Seq: s.seq, Kind: KindStreamData}, v)
+}
+
+// writeFrame writes a response other than the reply to a call.
+func (c *Conn) writeFrame(r *Response, body interface{}) error {
+	c.sending.Lock()
+	err := c.codec.WriteResponse(r, body)
+	c.sending.Unlock()
+	return err
+}
+
+// clientStream is a stream receiving the responses with its seq.
+type clientStream interface {
+	// frame reads the body of response, returning an error only if the
+	// connection is no longer usable.
+	frame(response *Response) error
+	// fail ends the stream when the connection is lost.
+	fail(err error)
+}
+
+// ClientStream receives the elements of a stream opened with
+// Client.Stream.  It is meant to be drained by a single goroutine.
+type ClientStream struct {
+	Cmd uint32 // the cmd the stream was opened on
+	Seq uint32 // sequence of the stream
+
+	client *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   func() bool
+	in     *inbox
+}
+
+// Stream opens a stream on cmd with args and returns it once the request
+// is sent.  elem gives the type of the elements, as for OnNotify.  The
+// stream is cancelled when ctx is done or Close is called.
+func (client *Client) Stream(ctx context.Context, cmd uint32, args interface{}, elem interface{}) (*ClientStream, error) {
+	return client.StreamWithWindow(ctx, cmd, args, elem, DefaultStreamWindow)
+}
+
+// StreamWithWindow is like Stream but lets the server run window elements
+// ahead of the receiver instead of DefaultStreamWindow.
+func (client *Client) StreamWithWindow(ctx context.Context, cmd uint32, args interface{}, elem interface{}, window uint32) (*ClientStream, error) {
+	if window == 0 {
+		window = DefaultStreamWindow
+	}
+	s := &ClientStream{
+		Cmd:    cmd,
+		client: client,
+		in:     newInbox(elemType(elem), window),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	req := Request{Cmd: cmd, Kind: KindStream, Window: window}
+	err := client.openStream(s.ctx, &req, args, s, func() {
+		s.Seq = req.Seq
+		s.stop = context.AfterFunc(s.ctx, func() {
+			client.endStream(s, context.Cause(s.ctx), true)
+		})
+	})
+	if err != nil {
+		if s.stop != nil {
+			s.stop()
+		}
+		s.cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openStream registers s under a new seq and writes req, which opens it,
+// with args.  setup is called with req.Seq set, before s is registered.
+func (client *Client) openStream(ctx context.Context, req *Request, args interface{}, s clientStream, setup func()) error {
+	client.reqMutex.Lock()
+	defer client.reqMutex.Unlock()
+
+	client.mutex.Lock()
+	if client.shutdown || client.closing {
+		client.mutex.Unlock()
+		return ErrShutdown
+	}
+	if ctx.Err() != nil {
+		client.mutex.Unlock()
+		return context.Cause(ctx)
+	}
+	req.Seq = client.nextSeq()
+	req.Timeout = timeoutMillis(ctx)
+	setup()
+	client.streams[req.Seq] = s
+	client.mutex.Unlock()
+
+	client.request = *req
+	if err := client.codec.WriteRequest(&client.request, args); err != nil {
+		client.mutex.Lock()
+		delete(client.streams, req.Seq)
+		client.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// writeFrame writes a request other than a call.
+func (client *Client) writeFrame(req Request, body interface{}) error {
+	client.reqMutex.Lock()
+	client.request = req
+	err := client.codec.WriteRequest(&client.request, body)
+	client.reqMutex.Unlock()
+	if debugLog && err != nil {
+		log.Println("rpc: writing stream frame:", err)
+	}
+	return err
+}
+
+// dropStream unregisters s, reporting false if it was already gone.
+func (client *Client) dropStream(seq uint32, s clientStream) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.streams[seq] != s {
+		return false
+	}
+	delete(client.streams, seq)
+	return true
+}
+
+// streamOpen reports whether s is still registered.
+func (client *Client) streamOpen(seq uint32, s clientStream) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.streams[seq] == s
+}
+
+// Recv returns the next element of the stream, a pointer to a freshly
+// decoded value of the element type.  It returns io.EOF once the server
+// has ended the stream, and the error of the stream if it failed or was
+// cancelled.
+func (s *ClientStream) Recv() (interface{}, error) {
+	v, grant, err := s.in.next(context.Background())
+	if grant > 0 && s.client.streamOpen(s.Seq, s) {
+		s.client.writeFrame(Request{Cmd: s.Cmd, Seq: s.Seq, Kind: KindWindow, Window: grant}, invalidRequest)
+	}
+	return v, err
+}
+
+// Context returns the context of the stream.
+func (s *ClientStream) Context() context.Context {
+	return s.ctx
+}
+
+// Close cancels the stream if it is still running.  Recv then returns
+// context.Canceled.
+func (s *ClientStream) Close() error {
+	s.client.endStream(s, context.Canceled, true)
+	return nil
+}
+
+// endStream ends s with err unless it has already ended.  If cancel is
+// set, the server is told to stop sending and the elements not received
+// yet are dropped.
+func (client *Client) endStream(s *ClientStream, err error, cancel bool) {
+	if !client.dropStream(s.Seq, s) {
+		return
+	}
+	if cancel {
+		client.writeFrame(Request{Cmd: s.Cmd, Seq: s.Seq, Kind: KindCancel}, invalidRequest)
+	}
+	s.finish(err, cancel)
+}
+
+// finish delivers the error ending the stream and releases its context.
+func (s *ClientStream) finish(err error, drop bool) {
+	s.stop()
+	s.cancel()
+	s.in.end(err, drop)
+}
+
+func (s *ClientStream) fail(err error) {
+	s.finish(err, false)
+}
+
+func (s *ClientStream) frame(response *Response) error {
+	client := s.client
+	if response.Kind != KindStreamData {
+		var end error = io.EOF
+		var err error
+		switch {
+		case response.Error != 0:
+			end, err = client.readError(response)
+		case response.Kind != KindStreamEnd:
+			end = ErrNoStreams
+			fallthrough
+		default:
+			err = client.codec.ReadResponseBody(nil)
+		}
+		if err != nil {
+			err = errors.New("reading stream body: " + err.Error())
+		}
+		client.endStream(s, end, false)
+		return err
+	}
+	body := reflect.New(s.in.typ).Interface()
+	if err := client.codec.ReadResponseBody(body); err != nil {
+		return errors.New("reading stream body: " + err.Error())
+	}
+	if !s.in.put(body) {
+		client.endStream(s, errWindowExceeded, true)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	server := NewServer()
+	var sent int32
+	count := func(ctx context.Context, n int, stream *ServerStream) error {
+		for i := 0; i < n; i++ {
+			if err := stream.Send(i); err != nil {
+				return err
+			}
+			atomic.AddInt32(&sent, 1)
+		}
+		if n == 3 {
+			return Error(7)
+		}
+		return nil
+	}
+	if err := server.RegisterStream(1, count); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(2, Add); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+
+	// The server stops once the window is full.
+	s, err := c.StreamWithWindow(context.Background(), 1, 100, 0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n != 4 {
+		t.Fatal("server sent", n, "elements ahead of a window of 4")
+	}
+	for i := 0; i < 100; i++ {
+		v, err := s.Recv()
+		if err != nil {
+			t.Fatal("Recv", i, err)
+		}
+		if *v.(*int) != i {
+			t.Fatal("element", i, "is", *v.(*int))
+		}
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Fatal("end of stream returned", err)
+	}
+
+	// A handler error ends the stream after the elements it sent.
+	s, err = c.Stream(context.Background(), 1, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.Recv(); err != nil {
+			t.Fatal("Recv", i, err)
+		}
+	}
+	if _, err := s.Recv(); err != Error(7) {
+		t.Fatal("failed stream returned", err)
+	}
+
+	// Closing the stream stops the handler.
+	atomic.StoreInt32(&sent, 0)
+	s, err = c.StreamWithWindow(context.Background(), 1, 1000, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := s.Recv(); err != context.Canceled {
+		t.Fatal("closed stream returned", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n > 4 {
+		t.Fatal("handler kept sending after Close:", n)
+	}
+
+	// Calls and streams don't mix.
+	if s, err = c.Stream(context.Background(), 2, &AddParams{1, 2}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); err == nil || err == io.EOF {
+		t.Fatal("stream on a call cmd returned", err)
+	}
+	var reply int
+	if err := c.Call(1, 3, &reply); err == nil {
+		t.Fatal("call on a stream cmd succeeded")
+	}
+}
+
+func TestRegisterStreamMismatch(t *testing.T) {
+	server := NewServer()
+	if err := server.RegisterStream(1, Add); err == nil {
+		t.Fatal("RegisterStream accepted a plain handler")
+	}
+	stream := func(ctx context.Context, n int, stream *ServerStream) error { return nil }
+	if err := server.Register(1, stream); err == nil {
+		t.Fatal("Register accepted a stream handler")
+	}
+	if err := server.RegisterDuplex(1, stream, 0); err == nil {
+		t.Fatal("RegisterDuplex accepted a server stream handler")
+	}
+}
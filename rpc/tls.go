@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of the connections served
+// by ServeConn.
+const tlsHandshakeTimeout = 10 * time.Second
+
+type tlsStateKey struct{}
+
+// tlsHandshake completes the handshake of conn and returns ctx carrying
+// the resulting connection state, which newConn picks up.
+func tlsHandshake(ctx context.Context, conn *tls.Conn) (context.Context, error) {
+	hctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(hctx); err != nil {
+		return ctx, err
+	}
+	state := conn.ConnectionState()
+	return context.WithValue(ctx, tlsStateKey{}, &state), nil
+}
+
+// TLS returns the state of the TLS connection served by ServeConn, or nil
+// if the connection is not a *tls.Conn.
+func (c *Conn) TLS() *tls.ConnectionState {
+	return c.tls
+}
+
+// ClientSubject returns the subject of the certificate the client of a
+// handler's connection authenticated with, as verified against the
+// ClientCAs of the server's tls.Config.  It reports false if the client
+// sent no certificate or the server did not verify it, so it can be
+// trusted for authorization.
+func ClientSubject(ctx context.Context) (pkix.Name, bool) {
+	conn := ConnFromContext(ctx)
+	if conn == nil || conn.tls == nil || len(conn.tls.VerifiedChains) == 0 {
+		return pkix.Name{}, false
+	}
+	return conn.tls.VerifiedChains[0][0].Subject, true
+}
+
+// ServeTLS is like Serve but serves TLS on the connections accepted on l,
+// as configured by config.  For mutual TLS, config.ClientAuth should be
+// tls.RequireAndVerifyClientCert; handlers then get the client identity
+// from ClientSubject.
+func (server *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	return server.Serve(tls.NewListener(l, config))
+}
+
+// ServeTLS accepts TLS connections on the listener and serves them with
+// DefaultServer.
+func ServeTLS(l net.Listener, config *tls.Config) error {
+	return DefaultServer.ServeTLS(l, config)
+}
+
+// DialTLS connects to an RPC server serving TLS at the specified network
+// address.  config gives the client certificate for mutual TLS.
+func DialTLS(network, address string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// DialHTTPPathTLS is like DialHTTPPath but connects to an HTTPS server,
+// as configured by config.
+func DialHTTPPathTLS(network, address, path string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return connectHTTP(conn, network, address, path)
+}
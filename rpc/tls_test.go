@@ -0,0 +1,204 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCA issues throwaway certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	next int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{pool: x509.NewCertPool()}
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca.cert, ca.key = ca.issue(t, tmpl)
+	ca.pool.AddCert(ca.cert)
+	return ca
+}
+
+// issue signs tmpl with the CA, or self-signs it if the CA has no
+// certificate yet.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.next++
+	tmpl.SerialNumber = big.NewInt(ca.next)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := tmpl, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// leaf returns a certificate for subject usable for usage.
+func (ca *testCA) leaf(t *testing.T, subject pkix.Name, usage x509.ExtKeyUsage) tls.Certificate {
+	cert, key := ca.issue(t, &x509.Certificate{
+		Subject:     subject,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+// newSubjectServer returns a server answering cmd 1 with the client
+// subject.
+func newSubjectServer(t *testing.T) *Server {
+	server := NewServer()
+	if err := Handle(server, 1, func(ctx context.Context, _ int, reply *string) error {
+		if ConnFromContext(ctx).TLS() == nil {
+			return Errorf(ErrInternal, "no TLS state")
+		}
+		subject, ok := ClientSubject(ctx)
+		if !ok {
+			return Error(401)
+		}
+		*reply = subject.CommonName
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// serveTLS serves a subject server on a local TLS listener, and returns
+// its address.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	server := newSubjectServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(l, config)
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	addr := serveTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.leaf(t, pkix.Name{CommonName: "server"}, x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	})
+
+	client, err := DialTLS("tcp", addr, &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.leaf(t, pkix.Name{CommonName: "alice"}, x509.ExtKeyUsageClientAuth)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if name, err := Invoke[int, string](client, 1, 0); err != nil || name != "alice" {
+		t.Fatalf("subject %q, %v; want alice", name, err)
+	}
+
+	// A client without a certificate is turned away during the
+	// handshake, which TLS 1.3 reports on the first read.
+	client, err = DialTLS("tcp", addr, &tls.Config{RootCAs: ca.pool})
+	if err == nil {
+		_, err = Invoke[int, string](client, 1, 0)
+		client.Close()
+	}
+	if err == nil {
+		t.Fatal("call without a client certificate succeeded")
+	}
+
+	// Nor is a certificate from another CA accepted.
+	other := newTestCA(t)
+	client, err = DialTLS("tcp", addr, &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{other.leaf(t, pkix.Name{CommonName: "mallory"}, x509.ExtKeyUsageClientAuth)},
+	})
+	if err == nil {
+		_, err = Invoke[int, string](client, 1, 0)
+		client.Close()
+	}
+	if err == nil {
+		t.Fatal("call with an untrusted client certificate succeeded")
+	}
+}
+
+func TestTLSWithoutClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	addr := serveTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.leaf(t, pkix.Name{CommonName: "server"}, x509.ExtKeyUsageServerAuth)},
+	})
+	if _, err := DialTLS("tcp", addr, &tls.Config{}); err == nil {
+		t.Fatal("dial succeeded without trusting the server")
+	}
+	client, err := DialTLS("tcp", addr, &tls.Config{RootCAs: ca.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := Invoke[int, string](client, 1, 0); err != Error(401) {
+		t.Fatalf("call returned %v, want %v", err, Error(401))
+	}
+}
+
+func TestDialHTTPPathTLS(t *testing.T) {
+	ca := newTestCA(t)
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", newSubjectServer(t))
+	ts := httptest.NewUnstartedServer(mux)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.leaf(t, pkix.Name{CommonName: "server"}, x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+	config := &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.leaf(t, pkix.Name{CommonName: "bob"}, x509.ExtKeyUsageClientAuth)},
+	}
+
+	client, err := DialHTTPPathTLS("tcp", addr, "/rpc", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if name, err := Invoke[int, string](client, 1, 0); err != nil || name != "bob" {
+		t.Fatalf("subject %q, %v; want bob", name, err)
+	}
+
+	if _, err := DialHTTPPathTLS("tcp", addr, "/other", config); err == nil {
+		t.Fatal("dial to a path without a server succeeded")
+	}
+}
@@ -0,0 +1,176 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Metadata keys carrying the trace of a call to the server.
+const (
+	TraceIDKey = "trace-id" // the trace the call belongs to
+	SpanIDKey  = "span-id"  // the span of the caller
+)
+
+// SpanContext identifies a span within its trace.
+type SpanContext struct {
+	TraceID string // 16 random bytes in hex
+	SpanID  string // 8 random bytes in hex
+}
+
+// A Span records one call, as seen by the client or by the server.
+type Span struct {
+	TraceID  string        `json:"trace_id"`
+	SpanID   string        `json:"span_id"`
+	ParentID string        `json:"parent_id,omitempty"` // span of the caller, empty for a root span
+	Kind     string        `json:"kind"`                // "client" or "server"
+	Cmd      uint32        `json:"cmd"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Code     uint32        `json:"code,omitempty"` // error code, 0 on success
+	Peer     string        `json:"peer,omitempty"` // address of the other side, if known
+}
+
+// A SpanExporter receives the spans once they are over.  ExportSpan is
+// called from the goroutine that made or served the call, so it should
+// not block for long.
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying sc as the current span.
+// Calls made with the returned context by a client tracing calls become
+// children of sc.
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// SpanFromContext returns the current span of ctx.  In a handler served
+// by a server tracing calls, it is the span of the call.
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(SpanContext)
+	return sc, ok
+}
+
+var idRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	idRand.Lock()
+	idRand.Read(b)
+	idRand.Unlock()
+	return hex.EncodeToString(b)
+}
+
+// TraceClient returns a client interceptor recording a span for every
+// call and sending its IDs to the server.  The span is a child of the
+// current span of the call's context, such as that of the handler making
+// the call, or starts a new trace.
+func TraceClient(exporter SpanExporter) ClientInterceptor {
+	return func(ctx context.Context, call *Call, next Invoker) error {
+		span := &Span{SpanID: newID(8), Kind: "client", Cmd: call.Cmd, Start: time.Now()}
+		if parent, ok := SpanFromContext(ctx); ok {
+			span.TraceID = parent.TraceID
+			span.ParentID = parent.SpanID
+		} else {
+			span.TraceID = newID(16)
+		}
+		ctx = ContextWithSpan(ctx, SpanContext{TraceID: span.TraceID, SpanID: span.SpanID})
+		ctx = WithMetadata(ctx, Metadata{TraceIDKey: span.TraceID, SpanIDKey: span.SpanID})
+		err := next(ctx, call)
+		span.Duration = time.Since(span.Start)
+		if call.peer != nil {
+			span.Peer = call.peer.String()
+		}
+		if err != nil {
+			span.Code = errorCode(err)
+		}
+		exporter.ExportSpan(span)
+		return err
+	}
+}
+
+// TraceServer returns a server interceptor recording a span for every
+// call.  The span continues the trace sent by the client, if any, and is
+// the current span of the handler's context.
+func TraceServer(exporter SpanExporter) Interceptor {
+	return func(ctx context.Context, cmd uint32, arg, reply interface{}, next Handler) error {
+		span := &Span{SpanID: newID(8), Kind: "server", Cmd: cmd, Start: time.Now()}
+		md := IncomingMetadata(ctx)
+		if span.TraceID = md[TraceIDKey]; span.TraceID != "" {
+			span.ParentID = md[SpanIDKey]
+		} else {
+			span.TraceID = newID(16)
+		}
+		if conn := ConnFromContext(ctx); conn != nil && conn.RemoteAddr() != nil {
+			span.Peer = conn.RemoteAddr().String()
+		}
+		ctx = ContextWithSpan(ctx, SpanContext{TraceID: span.TraceID, SpanID: span.SpanID})
+		err := next(ctx, cmd, arg, reply)
+		span.Duration = time.Since(span.Start)
+		if err != nil {
+			span.Code = errorCode(err)
+		}
+		exporter.ExportSpan(span)
+		return err
+	}
+}
+
+// JSONLinesExporter writes every span as a line of JSON, for local
+// analysis.
+type JSONLinesExporter struct {
+	mu     sync.Mutex // protects following
+	enc    *json.Encoder
+	closer io.Closer
+	err    error
+}
+
+// NewJSONLinesExporter returns an exporter writing the spans to w.
+func NewJSONLinesExporter(w io.Writer) *JSONLinesExporter {
+	return &JSONLinesExporter{enc: json.NewEncoder(w)}
+}
+
+// CreateJSONLinesExporter returns an exporter appending the spans to the
+// named file, which is created if needed.
+func CreateJSONLinesExporter(name string) (*JSONLinesExporter, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := NewJSONLinesExporter(f)
+	e.closer = f
+	return e, nil
+}
+
+// ExportSpan writes s.  Write errors are reported by Close.
+func (e *JSONLinesExporter) ExportSpan(s *Span) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = e.enc.Encode(s)
+	}
+	e.mu.Unlock()
+}
+
+// Close closes the file opened by CreateJSONLinesExporter and returns the
+// first error met writing spans.
+func (e *JSONLinesExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closer != nil {
+		if err := e.closer.Close(); e.err == nil {
+			e.err = err
+		}
+		e.closer = nil
+	}
+	return e.err
+}
@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter, err := CreateJSONLinesExporter(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	back := NewServer()
+	back.Use(TraceServer(exporter))
+	if err := back.Register(2, func(ctx context.Context, arg *AddParams, reply *int) error {
+		if arg.A < 0 {
+			return Error(5)
+		}
+		*reply = arg.A + arg.B
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go back.ServeConn(context.Background(), srv)
+	backClient := NewClient(cli)
+	defer backClient.Close()
+	backClient.Use(TraceClient(exporter))
+
+	// The front server forwards its calls to the back one.
+	front := NewServer()
+	front.Use(TraceServer(exporter))
+	if err := front.Register(1, func(ctx context.Context, arg *AddParams, reply *int) error {
+		return backClient.CallContext(ctx, 2, arg, reply)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv = net.Pipe()
+	go front.ServeConn(context.Background(), srv)
+	c := NewClient(cli)
+	defer c.Close()
+	c.Use(TraceClient(exporter))
+
+	reply := 0
+	if err := c.Call(1, &AddParams{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatal("call:", reply, err)
+	}
+	if err := c.Call(1, &AddParams{-1, 2}, &reply); err != Error(5) {
+		t.Fatal("failing call returned", err)
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var spans []Span
+	for s := bufio.NewScanner(f); s.Scan(); {
+		var span Span
+		if err := json.Unmarshal(s.Bytes(), &span); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, span)
+	}
+	if len(spans) != 8 {
+		t.Fatalf("%d spans exported, want 8", len(spans))
+	}
+	// Each call ends innermost first: back server, back client, front
+	// server, then the client.
+	for i := 0; i < 8; i += 4 {
+		backServer, backCall, frontServer, call := spans[i], spans[i+1], spans[i+2], spans[i+3]
+		if call.Kind != "client" || call.Cmd != 1 || call.ParentID != "" {
+			t.Fatalf("root span %+v", call)
+		}
+		for _, s := range []Span{backServer, backCall, frontServer} {
+			if s.TraceID != call.TraceID {
+				t.Fatalf("span %+v not in trace %s", s, call.TraceID)
+			}
+		}
+		if frontServer.Kind != "server" || frontServer.ParentID != call.SpanID {
+			t.Fatalf("front server span %+v, parent %s", frontServer, call.SpanID)
+		}
+		if backCall.Kind != "client" || backCall.Cmd != 2 || backCall.ParentID != frontServer.SpanID {
+			t.Fatalf("nested call span %+v, parent %s", backCall, frontServer.SpanID)
+		}
+		if backServer.ParentID != backCall.SpanID {
+			t.Fatalf("back server span %+v, parent %s", backServer, backCall.SpanID)
+		}
+		if call.Duration < backServer.Duration {
+			t.Fatal("root span shorter than a child")
+		}
+	}
+	if spans[0].TraceID == spans[4].TraceID {
+		t.Fatal("two calls share a trace")
+	}
+	if spans[4].Code != 5 || spans[7].Code != 5 {
+		t.Fatal("failing call recorded codes", spans[4].Code, spans[7].Code)
+	}
+}
@@ -0,0 +1,29 @@
+package rpc
+
+import "context"
+
+// Handle publishes handler as the handler of cmd, like Register but with
+// the argument and reply types checked at compile time.  The server calls
+// handler directly rather than through reflection.
+func Handle[A, R any](server *Server, cmd uint32, handler func(ctx context.Context, args A, reply *R) error) error {
+	return server.register(cmd, handler, KindCall, nil, func(ctx context.Context, arg, reply interface{}) error {
+		// arg may be a nil interface if A is an interface type.
+		a, _ := arg.(A)
+		return handler(ctx, a, reply.(*R))
+	})
+}
+
+// Invoke calls cmd with args and returns the decoded reply.
+func Invoke[A, R any](client *Client, cmd uint32, args A) (R, error) {
+	var reply R
+	err := client.Call(cmd, args, &reply)
+	return reply, err
+}
+
+// InvokeContext is like Invoke but the call is bounded by ctx, as with
+// Client.CallContext.
+func InvokeContext[A, R any](ctx context.Context, client *Client, cmd uint32, args A) (R, error) {
+	var reply R
+	err := client.CallContext(ctx, cmd, args, &reply)
+	return reply, err
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func typedAdd(ctx context.Context, arg *AddParams, reply *int) error {
+	*reply = arg.A + arg.B
+	return nil
+}
+
+// typedPair serves a server on a pipe and returns a client of it.
+func typedPair(server *Server) *Client {
+	cli, srv := net.Pipe()
+	go server.ServeConn(context.Background(), srv)
+	return NewClient(cli)
+}
+
+func TestHandleInvoke(t *testing.T) {
+	server := NewServer()
+	if err := Handle(server, 100, typedAdd); err != nil {
+		t.Fatal(err)
+	}
+	if err := Handle(server, 101, func(ctx context.Context, name string, reply *string) error {
+		if name == "" {
+			return Error(7)
+		}
+		*reply = "hello " + name
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var seen *AddParams
+	server.Use(func(ctx context.Context, cmd uint32, arg, reply interface{}, next Handler) error {
+		if p, ok := arg.(*AddParams); ok {
+			seen = p
+		}
+		return next(ctx, cmd, arg, reply)
+	})
+	c := typedPair(server)
+	defer c.Close()
+
+	sum, err := Invoke[*AddParams, int](c, 100, &AddParams{1, 2})
+	if err != nil || sum != 3 {
+		t.Fatal("Invoke returned", sum, err)
+	}
+	if seen == nil || seen.A != 1 {
+		t.Fatal("interceptor did not see the typed call")
+	}
+	greeting, err := InvokeContext[string, string](context.Background(), c, 101, "bob")
+	if err != nil || greeting != "hello bob" {
+		t.Fatal("InvokeContext returned", greeting, err)
+	}
+	if _, err := Invoke[string, string](c, 101, ""); err != Error(7) {
+		t.Fatal("failing handler returned", err)
+	}
+
+	type hidden struct{}
+	if err := Handle(server, 102, func(ctx context.Context, arg hidden, reply *int) error { return nil }); err == nil {
+		t.Fatal("Handle accepted an unexported argument type")
+	}
+}
+
+func benchmarkCall(b *testing.B, register func(*Server) error) {
+	server := NewServer()
+	if err := register(server); err != nil {
+		b.Fatal(err)
+	}
+	c := typedPair(server)
+	defer c.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reply := 0
+		if err := c.Call(100, &AddParams{i, 1}, &reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCallRegister(b *testing.B) {
+	benchmarkCall(b, func(s *Server) error { return s.Register(100, typedAdd) })
+}
+
+func BenchmarkCallHandle(b *testing.B) {
+	benchmarkCall(b, func(s *Server) error { return Handle(s, 100, typedAdd) })
+}
+
+// benchmarkDispatch measures the dispatch of a decoded call to its
+// handler, leaving the codec out.
+func benchmarkDispatch(b *testing.B, register func(*Server) error) {
+	server := NewServer()
+	if err := register(server); err != nil {
+		b.Fatal(err)
+	}
+	mtype := server.method[100]
+	ctx := context.Background()
+	arg := &AddParams{1, 2}
+	reply := 0
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := server.invoke(ctx, nil, mtype, 100, arg, &reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDispatchRegister(b *testing.B) {
+	benchmarkDispatch(b, func(s *Server) error { return s.Register(100, typedAdd) })
+}
+
+func BenchmarkDispatchHandle(b *testing.B) {
+	benchmarkDispatch(b, func(s *Server) error { return Handle(s, 100, typedAdd) })
+}